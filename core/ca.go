@@ -0,0 +1,205 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// caValidity is how long a generated root certificate is valid
+const caValidity = 10 * 365 * 24 * time.Hour
+
+// legacyCaSha1 is the root certificate earlier versions shipped with, its key is public
+// so it is removed from the system store like a replaced one
+const legacyCaSha1 = "f0a43ae8e1884ce134a995271f5cd7b0baf87080"
+
+func (a *App) caCertFile() string {
+	return filepath.Join(a.UserDir, "ca.crt")
+}
+
+func (a *App) caKeyFile() string {
+	return filepath.Join(a.UserDir, "ca.key")
+}
+
+func (a *App) retiredCaFile() string {
+	return filepath.Join(a.UserDir, "ca.retired")
+}
+
+// generateCa creates a root certificate and its key in PEM
+func generateCa(commonName string) ([]byte, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{commonName},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), nil
+}
+
+// loadCa reads the root certificate of this installation, one is generated on first run
+// so no two installations share a key
+func (a *App) loadCa() error {
+	crt, err := os.ReadFile(a.caCertFile())
+	var key []byte
+	if err == nil {
+		key, err = os.ReadFile(a.caKeyFile())
+	}
+	if err == nil {
+		if _, err = tls.X509KeyPair(crt, key); err == nil {
+			a.setCa(crt, key)
+			return nil
+		}
+		globalLogger.Esg(err, "stored CA is invalid, a new one is generated")
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return a.createCa()
+}
+
+// createCa generates a new root certificate and stores it, the key is readable by the current user only
+func (a *App) createCa() error {
+	crt, key, err := generateCa(a.AppName + " CA " + time.Now().Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(a.UserDir, 0700); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(a.caKeyFile(), key, 0600); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(a.caCertFile(), crt, 0644); err != nil {
+		return err
+	}
+	a.setCa(crt, key)
+	return nil
+}
+
+func (a *App) setCa(crt, key []byte) {
+	a.caMu.Lock()
+	defer a.caMu.Unlock()
+	a.PublicCrt = crt
+	a.PrivateKey = key
+}
+
+// ca returns the root certificate and key in PEM
+func (a *App) ca() ([]byte, []byte) {
+	a.caMu.RLock()
+	defer a.caMu.RUnlock()
+	return a.PublicCrt, a.PrivateKey
+}
+
+// caFingerprint is the SHA-256 of the root certificate, the install lock stores it so a new CA is installed again
+func (a *App) caFingerprint() string {
+	crt, _ := a.ca()
+	block, _ := pem.Decode(crt)
+	if block == nil {
+		return ""
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// RegenerateCa replaces the root certificate, the proxy signs with the new one right away and it is installed again
+func (a *App) RegenerateCa() error {
+	old, _ := a.ca()
+	if err := a.createCa(); err != nil {
+		return err
+	}
+	a.retireCa(old)
+	if err := proxyOnce.setCa(); err != nil {
+		return err
+	}
+	_ = os.Remove(a.LockFile)
+	go a.installCert()
+	return nil
+}
+
+func certSha1(crt []byte) string {
+	block, _ := pem.Decode(crt)
+	if block == nil {
+		return ""
+	}
+	sum := sha1.Sum(block.Bytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// retireCa remembers a replaced root certificate until the next installation removes it from the system store
+func (a *App) retireCa(crt []byte) {
+	fingerprint := certSha1(crt)
+	if fingerprint == "" {
+		return
+	}
+	file, err := os.OpenFile(a.retiredCaFile(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		globalLogger.Esg(err, "record replaced CA err")
+		return
+	}
+	defer file.Close()
+	_, _ = file.WriteString(fingerprint + "\n")
+}
+
+// retiredCas returns the SHA-1 of the root certificates to remove from the system store
+func (a *App) retiredCas() []string {
+	list := []string{legacyCaSha1}
+	data, err := os.ReadFile(a.retiredCaFile())
+	if err != nil {
+		return list
+	}
+	crt, _ := a.ca()
+	current := certSha1(crt)
+	for _, fingerprint := range strings.Fields(string(data)) {
+		if fingerprint != legacyCaSha1 && fingerprint != current {
+			list = append(list, fingerprint)
+		}
+	}
+	return list
+}
+
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of a file that already exists
+	if err := os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
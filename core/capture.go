@@ -0,0 +1,175 @@
+package core
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// teeBody streams a response to the client while copying it into the capture cache
+type teeBody struct {
+	body     io.ReadCloser
+	file     *os.File
+	path     string
+	size     int64
+	limit    int64
+	expected int64
+}
+
+func captureDir() string {
+	return filepath.Join(appOnce.UserDir, "capture")
+}
+
+func capturePath(urlSign string) string {
+	return filepath.Join(captureDir(), urlSign)
+}
+
+// CapturedFile returns the cached body of a resource if it was captured completely
+func CapturedFile(urlSign string) (string, bool) {
+	if urlSign == "" {
+		return "", false
+	}
+	path := capturePath(urlSign)
+	return path, FileExist(path)
+}
+
+func shouldCapture(resp *http.Response, classify string) bool {
+	if !globalConfig.CaptureBody || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	if resp.ContentLength > captureLimit() {
+		return false
+	}
+	for _, item := range globalConfig.CaptureTypes {
+		if item == classify {
+			return true
+		}
+	}
+	return false
+}
+
+func captureLimit() int64 {
+	return int64(globalConfig.CaptureMaxSize) * 1048576
+}
+
+// captureBody replaces the response body with one that also writes to the capture cache
+func captureBody(resp *http.Response, urlSign string) {
+	if err := CreateDirIfNotExist(captureDir()); err != nil {
+		globalLogger.err(err)
+		return
+	}
+	path := capturePath(urlSign)
+	file, err := os.Create(path + ".part")
+	if err != nil {
+		globalLogger.err(err)
+		return
+	}
+	resp.Body = &teeBody{
+		body:     resp.Body,
+		file:     file,
+		path:     path,
+		limit:    captureLimit(),
+		expected: resp.ContentLength,
+	}
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.body.Read(p)
+	if n > 0 && t.file != nil {
+		t.size += int64(n)
+		if t.size > t.limit {
+			t.abort()
+		} else if _, werr := t.file.Write(p[:n]); werr != nil {
+			t.abort()
+		}
+	}
+	if err == io.EOF && t.file != nil {
+		t.finish()
+	}
+	return n, err
+}
+
+func (t *teeBody) Close() error {
+	if t.file != nil {
+		// the client went away before the body ended
+		t.abort()
+	}
+	return t.body.Close()
+}
+
+func (t *teeBody) finish() {
+	_ = t.file.Close()
+	t.file = nil
+	if t.expected >= 0 && t.size != t.expected {
+		_ = os.Remove(t.path + ".part")
+		return
+	}
+	if err := os.Rename(t.path+".part", t.path); err != nil {
+		globalLogger.err(err)
+	}
+}
+
+func (t *teeBody) abort() {
+	_ = t.file.Close()
+	t.file = nil
+	_ = os.Remove(t.path + ".part")
+}
+
+// materialize moves a captured body to the save path and returns where it ended up
+func materialize(cachePath, savePath, sha256 string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(savePath), os.ModePerm); err != nil {
+		return "", err
+	}
+	part := savePath + PartSuffix
+	if err := os.Rename(cachePath, part); err != nil {
+		// the cache and the save directory may be on different volumes
+		if err = copyFile(cachePath, part); err != nil {
+			_ = os.Remove(part)
+			return "", err
+		}
+		_ = os.Remove(cachePath)
+	}
+	return commitPart(savePath, sha256)
+}
+
+func copyFile(src, dst string) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	destination, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(destination, source); err != nil {
+		destination.Close()
+		return err
+	}
+	return destination.Close()
+}
+
+func removeCaptured(urlSign string) {
+	if urlSign != "" {
+		_ = os.Remove(capturePath(urlSign))
+	}
+}
+
+// pruneCaptured removes the cached bodies of the resources that are not kept
+func pruneCaptured(kept map[string]bool) {
+	entries, err := os.ReadDir(captureDir())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		// bodies still being streamed finish or abort on their own
+		if !entry.IsDir() && !strings.HasSuffix(entry.Name(), ".part") && !kept[entry.Name()] {
+			_ = os.Remove(filepath.Join(captureDir(), entry.Name()))
+		}
+	}
+}
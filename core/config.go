@@ -9,21 +9,42 @@ import (
 
 // Config struct
 type Config struct {
-	storage       *Storage
-	Theme         string `json:"Theme"`
-	Host          string `json:"Host"`
-	Port          string `json:"Port"`
-	Quality       int    `json:"Quality"`
-	SaveDirectory string `json:"SaveDirectory"`
-	FilenameLen   int    `json:"FilenameLen"`
-	FilenameTime  bool   `json:"FilenameTime"`
-	UpstreamProxy string `json:"UpstreamProxy"`
-	OpenProxy     bool   `json:"OpenProxy"`
-	DownloadProxy bool   `json:"DownloadProxy"`
-	AutoProxy     bool   `json:"AutoProxy"`
-	WxAction      bool   `json:"WxAction"`
-	TaskNumber    int    `json:"TaskNumber"`
-	UserAgent     string `json:"UserAgent"`
+	storage           *Storage
+	Theme             string          `json:"Theme"`
+	Host              string          `json:"Host"`
+	Port              string          `json:"Port"`
+	Quality           int             `json:"Quality"`
+	SaveDirectory     string          `json:"SaveDirectory"`
+	FilenameLen       int             `json:"FilenameLen"`
+	FilenameTime      bool            `json:"FilenameTime"`
+	FilenameTemplate  string          `json:"FilenameTemplate"`
+	FileConflict      string          `json:"FileConflict"`
+	SkipDownloaded    bool            `json:"SkipDownloaded"`
+	UpstreamProxy     string          `json:"UpstreamProxy"`
+	OpenProxy         bool            `json:"OpenProxy"`
+	DownloadProxy     bool            `json:"DownloadProxy"`
+	AutoProxy         bool            `json:"AutoProxy"`
+	WxAction          bool            `json:"WxAction"`
+	SiteHandlers      map[string]bool `json:"SiteHandlers"`
+	TaskNumber        int             `json:"TaskNumber"`
+	UserAgent         string          `json:"UserAgent"`
+	RetryCount        int             `json:"RetryCount"`
+	StallTimeout      int             `json:"StallTimeout"`
+	VerifyETag        bool            `json:"VerifyETag"`
+	SpeedLimit        int             `json:"SpeedLimit"`
+	MaxDownloads      int             `json:"MaxDownloads"`
+	HeaderRules       []HeaderRule    `json:"HeaderRules"`
+	GroupRules        []GroupRule     `json:"GroupRules"`
+	MitmRules         []MitmRule      `json:"MitmRules"`
+	MitmInspectPinned bool            `json:"MitmInspectPinned"`
+	CaptureBody       bool            `json:"CaptureBody"`
+	CaptureMaxSize    int             `json:"CaptureMaxSize"`
+	CaptureTypes      []string        `json:"CaptureTypes"`
+	RecordTraffic     bool            `json:"RecordTraffic"`
+	RecordBodyMaxSize int             `json:"RecordBodyMaxSize"`
+	LiveMaxDuration   int             `json:"LiveMaxDuration"`
+	LiveMaxSize       int             `json:"LiveMaxSize"`
+	LiveSplitDuration int             `json:"LiveSplitDuration"`
 }
 
 func initConfig() *Config {
@@ -37,13 +58,45 @@ func initConfig() *Config {
   "SaveDirectory": "",
   "FilenameLen": 400,
   "FilenameTime": true,
+  "FilenameTemplate": "",
+  "FileConflict": "rename",
+  "SkipDownloaded": false,
   "UpstreamProxy": "",
   "OpenProxy": false,
   "DownloadProxy": false,
   "AutoProxy": true,
   "WxAction": true,
+  "SiteHandlers": {},
   "TaskNumber": __TaskNumber__,
-  "UserAgent": "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36"
+  "UserAgent": "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36",
+  "RetryCount": 5,
+  "StallTimeout": 30,
+  "VerifyETag": false,
+  "SpeedLimit": 0,
+  "MaxDownloads": 3,
+  "HeaderRules": [
+    {
+      "Domain": "*",
+      "Allow": ["Cookie", "Referer", "Origin", "Authorization", "User-Agent", "X-*"],
+      "Deny": []
+    }
+  ],
+  "GroupRules": [
+    {
+      "Domain": "*",
+      "IgnoreParams": ["range", "bytestart", "byteend", "_"]
+    }
+  ],
+  "MitmRules": [],
+  "MitmInspectPinned": false,
+  "CaptureBody": false,
+  "CaptureMaxSize": 20,
+  "CaptureTypes": ["image", "audio"],
+  "RecordTraffic": false,
+  "RecordBodyMaxSize": 0,
+  "LiveMaxDuration": 0,
+  "LiveMaxSize": 0,
+  "LiveSplitDuration": 0
 }
 `
 		def = strings.ReplaceAll(def, "__TaskNumber__", strconv.Itoa(runtime.NumCPU()*2))
@@ -51,6 +104,8 @@ func initConfig() *Config {
 			storage: NewStorage("config.json", []byte(def)),
 		}
 
+		// settings added after the stored file was written keep their defaults
+		_ = json.Unmarshal([]byte(def), &globalConfig)
 		data, err := globalConfig.storage.Load()
 		if err == nil {
 			_ = json.Unmarshal(data, &globalConfig)
@@ -70,6 +125,9 @@ func (c *Config) setConfig(config Config) {
 	c.SaveDirectory = config.SaveDirectory
 	c.FilenameLen = config.FilenameLen
 	c.FilenameTime = config.FilenameTime
+	c.FilenameTemplate = config.FilenameTemplate
+	c.FileConflict = config.FileConflict
+	c.SkipDownloaded = config.SkipDownloaded
 	c.UpstreamProxy = config.UpstreamProxy
 	c.UserAgent = config.UserAgent
 	c.OpenProxy = config.OpenProxy
@@ -77,6 +135,30 @@ func (c *Config) setConfig(config Config) {
 	c.AutoProxy = config.AutoProxy
 	c.TaskNumber = config.TaskNumber
 	c.WxAction = config.WxAction
+	c.SiteHandlers = config.SiteHandlers
+	c.RetryCount = config.RetryCount
+	c.StallTimeout = config.StallTimeout
+	c.VerifyETag = config.VerifyETag
+	c.HeaderRules = config.HeaderRules
+	c.GroupRules = config.GroupRules
+	c.MitmRules = config.MitmRules
+	c.MitmInspectPinned = config.MitmInspectPinned
+	c.CaptureBody = config.CaptureBody
+	c.CaptureMaxSize = config.CaptureMaxSize
+	c.CaptureTypes = config.CaptureTypes
+	c.RecordTraffic = config.RecordTraffic
+	c.RecordBodyMaxSize = config.RecordBodyMaxSize
+	c.LiveMaxDuration = config.LiveMaxDuration
+	c.LiveMaxSize = config.LiveMaxSize
+	c.LiveSplitDuration = config.LiveSplitDuration
+	if c.MaxDownloads != config.MaxDownloads {
+		c.MaxDownloads = config.MaxDownloads
+		queueOnce.schedule()
+	}
+	if c.SpeedLimit != config.SpeedLimit {
+		c.SpeedLimit = config.SpeedLimit
+		globalLimiter.SetRate(int64(c.SpeedLimit) * 1024)
+	}
 	if oldProxy != c.UpstreamProxy {
 		proxyOnce.setTransport()
 	}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DashDownloader downloads the chosen video and audio representations of a static MPD and muxes them into one MP4
+type DashDownloader struct {
+	Url              string
+	FileName         string
+	Video            string
+	Audio            string
+	Headers          map[string]string
+	CapturedUrl      string
+	Limiter          *RateLimiter
+	Manifest         *DashManifest
+	Sha256           string
+	progressCallback ProgressCallback
+	ctx              context.Context
+}
+
+func NewDashDownloader(url, filename string) *DashDownloader {
+	return &DashDownloader{
+		Url:      url,
+		FileName: filename,
+		ctx:      context.Background(),
+	}
+}
+
+// dashTrackFiles are the per track files a download of fileName leaves behind until they are muxed
+func dashTrackFiles(fileName string) []string {
+	base := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	return []string{base + ".video.mp4", base + ".audio.mp4"}
+}
+
+func (dd *DashDownloader) newTrackDownloader(fileName string) *HlsDownloader {
+	downloader := NewHlsDownloader(dd.Url, fileName)
+	downloader.ctx = dd.ctx
+	downloader.Headers = dd.Headers
+	downloader.CapturedUrl = dd.CapturedUrl
+	downloader.Limiter = dd.Limiter
+	downloader.prepare()
+	return downloader
+}
+
+// LoadManifest fetches and parses the MPD
+func (dd *DashDownloader) LoadManifest() (*DashManifest, error) {
+	data, err := dd.newTrackDownloader("").fetchRetry(dd.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := ParseMpd(data, dd.Url)
+	if err != nil {
+		return nil, err
+	}
+	dd.Manifest = manifest
+	return manifest, nil
+}
+
+func (dd *DashDownloader) Start() error {
+	manifest, err := dd.LoadManifest()
+	if err != nil {
+		return err
+	}
+	if manifest.Dynamic {
+		return fmt.Errorf("暂不支持直播 DASH")
+	}
+	dd.FileName = strings.TrimSuffix(dd.FileName, filepath.Ext(dd.FileName)) + ".mp4"
+
+	var selected []*DashRepresentation
+	for _, item := range []struct{ kind, id string }{{"video", dd.Video}, {"audio", dd.Audio}} {
+		if representation := manifest.Select(item.kind, item.id); representation != nil {
+			selected = append(selected, representation)
+		}
+	}
+	if len(selected) == 0 {
+		return fmt.Errorf("MPD 未包含音视频")
+	}
+
+	// the tracks share one progress report, weighted by their bandwidth
+	var totalBandwidth int64
+	for _, representation := range selected {
+		totalBandwidth += max(1, representation.Bandwidth)
+	}
+	var finishedWeight float64
+	var files []string
+	for _, representation := range selected {
+		playlist, err := manifest.Segments(representation)
+		if err != nil {
+			return err
+		}
+		trackFile := dashTrackFiles(dd.FileName)[0]
+		if representation.Kind == "audio" {
+			trackFile = dashTrackFiles(dd.FileName)[1]
+		}
+		downloader := dd.newTrackDownloader(trackFile)
+		downloader.Playlist = playlist
+		weight := float64(max(1, representation.Bandwidth)) / float64(totalBandwidth)
+		offset := finishedWeight
+		downloader.progressCallback = func(progress DownloadProgress) {
+			if dd.progressCallback == nil {
+				return
+			}
+			progress.Percent = offset*100 + progress.Percent*weight
+			dd.progressCallback(progress)
+		}
+		if err = downloader.download(); err != nil {
+			return err
+		}
+		finishedWeight += weight
+		files = append(files, downloader.FileName)
+	}
+
+	// the output is written to a part file, so an interrupted mux never looks like a finished download
+	part := dd.FileName + PartSuffix
+	if len(files) == 1 && len(manifest.doc.Periods) <= 1 {
+		// a single track is already a playable fragmented MP4, one of several periods has an init segment per period
+		if err = os.Rename(files[0], part); err != nil {
+			return err
+		}
+	} else {
+		if err = MuxFragmented(part, files...); err != nil {
+			_ = os.Remove(part)
+			return err
+		}
+		for _, fileName := range files {
+			_ = os.Remove(fileName)
+		}
+	}
+	if dd.Sha256, err = FileSha256(part); err != nil {
+		return err
+	}
+	dd.FileName, err = commitPart(dd.FileName, dd.Sha256)
+	return err
+}
@@ -1,9 +1,10 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
@@ -11,9 +12,36 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
-type ProgressCallback func(totalDownloaded float64)
+// minSplitSize is the smallest chunk an idle task will split off from a busy one
+const minSplitSize int64 = 1048576
+
+var errDownloadStalled = errors.New("no data received before the stall timeout")
+
+// progressInterval is the minimum time between two progress callbacks
+const progressInterval = 250 * time.Millisecond
+
+type ChunkProgress struct {
+	TaskID     int   `json:"TaskID"`
+	RangeStart int64 `json:"RangeStart"`
+	RangeEnd   int64 `json:"RangeEnd"`
+	Downloaded int64 `json:"Downloaded"`
+	Completed  bool  `json:"Completed"`
+}
+
+type DownloadProgress struct {
+	Downloaded int64           `json:"Downloaded"`
+	Total      int64           `json:"Total"`
+	Percent    float64         `json:"Percent"`
+	Speed      int64           `json:"Speed"` // bytes per second, moving average
+	Eta        int64           `json:"Eta"`   // seconds, -1 when unknown
+	Chunks     []ChunkProgress `json:"Chunks"`
+	Duration   float64         `json:"Duration"` // seconds recorded, only set for live streams
+}
+
+type ProgressCallback func(progress DownloadProgress)
 
 type DownloadTask struct {
 	taskID         int
@@ -32,8 +60,22 @@ type FileDownloader struct {
 	totalTasks       int
 	TotalSize        int64
 	IsMultiPart      bool
+	AcceptRanges     bool
+	ETag             string
+	LastModified     string
+	Header           http.Header
+	Sha256           string
+	Limiter          *RateLimiter
+	Headers          map[string]string
+	MediaInfo        MediaInfo
+	DecodeStr        string
 	DownloadTaskList []*DownloadTask
 	progressCallback ProgressCallback
+	journal          *DownloadJournal
+	isResumed        bool
+	mu               sync.Mutex
+	ctx              context.Context
+	err              error
 }
 
 func NewFileDownloader(url, filename string, totalTasks int) *FileDownloader {
@@ -44,13 +86,25 @@ func NewFileDownloader(url, filename string, totalTasks int) *FileDownloader {
 		IsMultiPart:      false,
 		TotalSize:        0,
 		DownloadTaskList: make([]*DownloadTask, 0),
+		ctx:              context.Background(),
 	}
 }
 
-func (fd *FileDownloader) buildClient() *http.Client {
+// downloadProxyUrl returns the upstream proxy downloads go through, nil for a direct connection
+func downloadProxyUrl() *url.URL {
+	if globalConfig.DownloadProxy && globalConfig.UpstreamProxy != "" && !strings.Contains(globalConfig.UpstreamProxy, globalConfig.Port) {
+		proxyURL, err := url.Parse(globalConfig.UpstreamProxy)
+		if err == nil {
+			return proxyURL
+		}
+	}
+	return nil
+}
+
+func newDownloadClient(proxyUrl *url.URL) *http.Client {
 	transport := &http.Transport{}
-	if fd.ProxyUrl != nil {
-		transport.Proxy = http.ProxyURL(fd.ProxyUrl)
+	if proxyUrl != nil {
+		transport.Proxy = http.ProxyURL(proxyUrl)
 	}
 	// Cookie handle
 	jar, _ := cookiejar.New(nil)
@@ -60,6 +114,37 @@ func (fd *FileDownloader) buildClient() *http.Client {
 	}
 }
 
+// retryDelay is the exponential backoff before the given retry attempt
+func retryDelay(attempt int) time.Duration {
+	return time.Duration(1<<uint(min(attempt-1, 5))) * time.Second
+}
+
+// waitLimit throttles a reader by the global and an optional per-download speed limit
+func waitLimit(ctx context.Context, limiter *RateLimiter, n int) error {
+	if globalLimiter != nil {
+		if err := globalLimiter.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	if limiter != nil {
+		return limiter.WaitN(ctx, n)
+	}
+	return nil
+}
+
+func (fd *FileDownloader) buildClient() *http.Client {
+	return newDownloadClient(fd.ProxyUrl)
+}
+
+// setHeaders applies the default headers and then replays the ones captured with the resource
+func (fd *FileDownloader) setHeaders(request *http.Request) {
+	request.Header.Set("User-Agent", globalConfig.UserAgent)
+	request.Header.Set("Referer", fd.Referer)
+	for name, value := range fd.Headers {
+		request.Header.Set(name, value)
+	}
+}
+
 func (fd *FileDownloader) init() error {
 	parsedURL, err := url.Parse(fd.Url)
 	if err != nil {
@@ -69,14 +154,14 @@ func (fd *FileDownloader) init() error {
 		fd.Referer = parsedURL.Scheme + "://" + parsedURL.Host + "/"
 	}
 
-	if globalConfig.DownloadProxy && globalConfig.UpstreamProxy != "" && !strings.Contains(globalConfig.UpstreamProxy, globalConfig.Port) {
-		proxyURL, err := url.Parse(globalConfig.UpstreamProxy)
-		if err == nil {
-			fd.ProxyUrl = proxyURL
-		}
-	}
+	fd.ProxyUrl = downloadProxyUrl()
 
-	resp, e := http.Head(fd.Url)
+	headRequest, err := http.NewRequestWithContext(fd.ctx, "HEAD", fd.Url, nil)
+	if err != nil {
+		return err
+	}
+	fd.setHeaders(headRequest)
+	resp, e := fd.buildClient().Do(headRequest)
 	if e != nil {
 		return e
 	}
@@ -87,7 +172,11 @@ func (fd *FileDownloader) init() error {
 		return fmt.Errorf("invalid file")
 	}
 
-	if resp.Header.Get("Accept-Ranges") == "bytes" && fd.TotalSize > 10485760 {
+	fd.Header = resp.Header
+	fd.AcceptRanges = resp.Header.Get("Accept-Ranges") == "bytes"
+	fd.ETag = resp.Header.Get("ETag")
+	fd.LastModified = resp.Header.Get("Last-Modified")
+	if fd.AcceptRanges && fd.TotalSize > 10485760 {
 		fd.IsMultiPart = true
 	}
 
@@ -100,11 +189,17 @@ func (fd *FileDownloader) init() error {
 		return err
 	}
 
-	fd.File, err = os.OpenFile(fd.FileName, os.O_RDWR|os.O_CREATE, 0644)
+	fd.loadJournal()
+
+	fd.File, err = os.OpenFile(fd.FileName+PartSuffix, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return fmt.Errorf("文件初始化失败: %w", err)
 	}
 
+	if fd.isResumed {
+		return nil
+	}
+
 	if err = fd.File.Truncate(fd.TotalSize); err != nil {
 		fd.File.Close()
 		return fmt.Errorf("文件大小设置失败: %w", err)
@@ -112,7 +207,97 @@ func (fd *FileDownloader) init() error {
 	return nil
 }
 
+// loadJournal restores the task list of a previous run when the remote file is unchanged
+func (fd *FileDownloader) loadJournal() {
+	journal, err := LoadJournal(fd.FileName)
+	if err != nil {
+		return
+	}
+	if !FileExist(fd.FileName+PartSuffix) && FileExist(fd.FileName) {
+		// journals written before part files were used point at the target itself
+		_ = os.Rename(fd.FileName, fd.FileName+PartSuffix)
+	}
+	info, err := os.Stat(fd.FileName + PartSuffix)
+	resumable := err == nil && info.Size() == fd.TotalSize &&
+		journal.Matches(fd.ETag, fd.LastModified, fd.TotalSize) &&
+		journal.IsMultiPart == fd.IsMultiPart &&
+		(fd.AcceptRanges || journal.DownloadedSize() == 0)
+	if !resumable {
+		journal.Remove()
+		return
+	}
+
+	for _, task := range journal.Tasks {
+		fd.DownloadTaskList = append(fd.DownloadTaskList, &DownloadTask{
+			taskID:         task.TaskID,
+			rangeStart:     task.RangeStart,
+			rangeEnd:       task.RangeEnd,
+			downloadedSize: task.DownloadedSize,
+			isCompleted:    task.IsCompleted,
+		})
+	}
+	fd.journal = journal
+	fd.isResumed = true
+}
+
+func (fd *FileDownloader) saveJournal(force bool) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if fd.journal == nil {
+		fd.journal = &DownloadJournal{}
+	}
+	if !force && time.Since(fd.journal.lastSave) < time.Second {
+		return
+	}
+	fd.journal.Url = fd.Url
+	fd.journal.FileName = fd.FileName
+	fd.journal.ETag = fd.ETag
+	fd.journal.LastModified = fd.LastModified
+	fd.journal.TotalSize = fd.TotalSize
+	fd.journal.IsMultiPart = fd.IsMultiPart
+	fd.journal.MediaInfo = fd.MediaInfo
+	fd.journal.DecodeStr = fd.DecodeStr
+	fd.journal.Tasks = fd.journal.Tasks[:0]
+	for _, task := range fd.DownloadTaskList {
+		fd.journal.Tasks = append(fd.journal.Tasks, JournalTask{
+			TaskID:         task.taskID,
+			RangeStart:     task.rangeStart,
+			RangeEnd:       task.rangeEnd,
+			DownloadedSize: task.downloadedSize,
+			IsCompleted:    task.isCompleted,
+		})
+	}
+	if err := fd.journal.Save(); err != nil {
+		globalLogger.Esg(err, "保存下载日志失败")
+	}
+}
+
+// finishJournal removes the journal of a completed download or persists the final state of an unfinished one, it reports whether every task completed
+func (fd *FileDownloader) finishJournal() bool {
+	fd.mu.Lock()
+	completed := true
+	for _, task := range fd.DownloadTaskList {
+		if !task.isCompleted {
+			completed = false
+			break
+		}
+	}
+	fd.mu.Unlock()
+
+	if !completed {
+		fd.saveJournal(true)
+		return false
+	}
+	if fd.journal != nil {
+		fd.journal.Remove()
+	}
+	return true
+}
+
 func (fd *FileDownloader) createDownloadTasks() {
+	if fd.isResumed {
+		return
+	}
 	if fd.IsMultiPart {
 		if int64(fd.totalTasks) > fd.TotalSize {
 			fd.totalTasks = int(fd.TotalSize)
@@ -134,84 +319,298 @@ func (fd *FileDownloader) createDownloadTasks() {
 		fd.DownloadTaskList = append(fd.DownloadTaskList, &DownloadTask{
 			taskID:         0,
 			rangeStart:     0,
-			rangeEnd:       0,
+			rangeEnd:       fd.TotalSize - 1,
 			downloadedSize: 0,
 			isCompleted:    false,
 		})
 	}
+	fd.saveJournal(true)
 }
 
 func (fd *FileDownloader) startDownload() {
 	waitGroup := &sync.WaitGroup{}
 	progressChan := make(chan int64)
+	totalDownloaded := int64(0)
 	for _, task := range fd.DownloadTaskList {
-		go fd.startDownloadTask(waitGroup, progressChan, task)
+		totalDownloaded += task.downloadedSize
+		if task.isCompleted {
+			continue
+		}
 		waitGroup.Add(1)
+		go fd.startDownloadTask(waitGroup, progressChan, task)
 	}
 	go func() {
 		waitGroup.Wait()
 		close(progressChan)
 	}()
 
-	if fd.progressCallback != nil {
-		totalDownloaded := int64(0)
-		for progress := range progressChan {
-			totalDownloaded += progress
-			fd.progressCallback(float64(totalDownloaded) * 100 / float64(fd.TotalSize))
+	var speed float64
+	lastTime := time.Now()
+	lastDownloaded := totalDownloaded
+	for progress := range progressChan {
+		totalDownloaded += progress
+		now := time.Now()
+		elapsed := now.Sub(lastTime)
+		if elapsed < progressInterval && totalDownloaded < fd.TotalSize {
+			continue
+		}
+		instant := float64(totalDownloaded-lastDownloaded) / elapsed.Seconds()
+		if speed == 0 {
+			speed = instant
+		} else {
+			speed = 0.3*instant + 0.7*speed
 		}
+		lastTime = now
+		lastDownloaded = totalDownloaded
+		fd.emitProgress(totalDownloaded, speed)
 	}
+	fd.emitProgress(totalDownloaded, speed)
 }
 
+func (fd *FileDownloader) emitProgress(totalDownloaded int64, speed float64) {
+	if fd.progressCallback == nil {
+		return
+	}
+	progress := DownloadProgress{
+		Downloaded: totalDownloaded,
+		Total:      fd.TotalSize,
+		Percent:    float64(totalDownloaded) * 100 / float64(fd.TotalSize),
+		Speed:      int64(speed),
+		Eta:        -1,
+	}
+	if speed > 0 {
+		progress.Eta = int64(float64(fd.TotalSize-totalDownloaded) / speed)
+	}
+	fd.mu.Lock()
+	for _, task := range fd.DownloadTaskList {
+		progress.Chunks = append(progress.Chunks, ChunkProgress{
+			TaskID:     task.taskID,
+			RangeStart: task.rangeStart,
+			RangeEnd:   task.rangeEnd,
+			Downloaded: task.downloadedSize,
+			Completed:  task.isCompleted,
+		})
+	}
+	fd.mu.Unlock()
+	fd.progressCallback(progress)
+}
+
+// startDownloadTask downloads one chunk, retrying with exponential backoff, and then helps out by splitting the largest unfinished chunk
 func (fd *FileDownloader) startDownloadTask(waitGroup *sync.WaitGroup, progressChan chan int64, task *DownloadTask) {
 	defer waitGroup.Done()
-	request, err := http.NewRequest("GET", fd.Url, nil)
+	retryCount := globalConfig.RetryCount
+	if retryCount < 0 {
+		retryCount = 0
+	}
+
+	var err error
+	for attempt := 0; attempt <= retryCount; attempt++ {
+		if attempt > 0 {
+			delay := retryDelay(attempt)
+			globalLogger.Warn().Err(err).Msgf("任务%d第%d次重试，等待%s", task.taskID, attempt, delay)
+			select {
+			case <-fd.ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+		err = fd.downloadTask(progressChan, task)
+		if err == nil {
+			break
+		}
+		if fd.ctx.Err() != nil {
+			return
+		}
+	}
 	if err != nil {
-		globalLogger.Error().Stack().Err(err).Msgf("任务%d创建请求出错", task.taskID)
+		globalLogger.Esg(err, "任务%d下载失败", task.taskID)
+		fd.mu.Lock()
+		if fd.err == nil {
+			fd.err = fmt.Errorf("分片%d下载失败: %w", task.taskID, err)
+		}
+		fd.mu.Unlock()
 		return
 	}
-	request.Header.Set("User-Agent", globalConfig.UserAgent)
-	request.Header.Set("Referer", fd.Referer)
-	if fd.IsMultiPart {
-		request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", task.rangeStart, task.rangeEnd))
+
+	if newTask := fd.splitLargestTask(); newTask != nil {
+		waitGroup.Add(1)
+		go fd.startDownloadTask(waitGroup, progressChan, newTask)
+	}
+}
+
+// downloadTask makes a single attempt at fetching the missing part of a chunk
+func (fd *FileDownloader) downloadTask(progressChan chan int64, task *DownloadTask) error {
+	stallTimeout := time.Duration(globalConfig.StallTimeout) * time.Second
+	if stallTimeout <= 0 {
+		stallTimeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithCancelCause(fd.ctx)
+	defer cancel(nil)
+	watchdog := time.AfterFunc(stallTimeout, func() {
+		cancel(errDownloadStalled)
+	})
+	defer watchdog.Stop()
+
+	request, err := http.NewRequestWithContext(ctx, "GET", fd.Url, nil)
+	if err != nil {
+		return err
+	}
+	fd.setHeaders(request)
+	fd.mu.Lock()
+	offset := task.rangeStart + task.downloadedSize
+	rangeEnd := task.rangeEnd
+	fd.mu.Unlock()
+	if fd.IsMultiPart || offset > task.rangeStart {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, rangeEnd))
 	}
 
 	resp, err := fd.buildClient().Do(request)
 	if err != nil {
-		log.Printf("任务%d发送下载请求出错！%s", task.taskID, err)
-		return
+		if context.Cause(ctx) == errDownloadStalled {
+			return errDownloadStalled
+		}
+		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if err := checkResponseRange(resp, offset, fd.TotalSize); err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusOK && resp.Header.Get("Content-MD5") != "" {
+		fd.mu.Lock()
+		fd.Header.Set("Content-MD5", resp.Header.Get("Content-MD5"))
+		fd.mu.Unlock()
+	}
+	if task.rangeStart > 0 && resp.StatusCode != http.StatusPartialContent {
+		// a full body starts at byte 0 and cannot be written at the offset of this chunk
+		return fmt.Errorf("服务器未返回分段内容: %s", resp.Status)
+	}
+	if task.downloadedSize > 0 && resp.StatusCode != http.StatusPartialContent {
+		// the server ignored the range, start this task over
+		fd.mu.Lock()
+		discarded := task.downloadedSize
+		task.downloadedSize = 0
+		fd.mu.Unlock()
+		progressChan <- -discarded
+	}
 	buf := make([]byte, 8192)
 	for {
 		n, err := resp.Body.Read(buf)
 		if n > 0 {
-			_, err := fd.File.WriteAt(buf[:n], task.rangeStart+task.downloadedSize)
-			if err != nil {
-				log.Printf("任务%d写入文件时出现错误！位置:%d, err: %s\n", task.taskID, task.rangeStart+task.downloadedSize, err)
-				return
+			watchdog.Reset(stallTimeout)
+			if err := waitLimit(ctx, fd.Limiter, n); err != nil {
+				return err
+			}
+			watchdog.Reset(stallTimeout)
+			fd.mu.Lock()
+			offset = task.rangeStart + task.downloadedSize
+			remaining := task.rangeEnd - offset + 1
+			fd.mu.Unlock()
+			if int64(n) > remaining {
+				// the chunk was split while this request was in flight
+				n = int(remaining)
+			}
+			if _, err := fd.File.WriteAt(buf[:n], offset); err != nil {
+				return fmt.Errorf("写入文件时出现错误！位置:%d, err: %w", offset, err)
 			}
 			downSize := int64(n)
+			fd.mu.Lock()
+			if offset+downSize-1 > task.rangeEnd {
+				downSize = task.rangeEnd - offset + 1
+			}
 			task.downloadedSize += downSize
+			done := task.rangeStart+task.downloadedSize > task.rangeEnd
+			if done {
+				task.isCompleted = true
+			}
+			fd.mu.Unlock()
+			fd.saveJournal(false)
 			progressChan <- downSize
+			if done {
+				return nil
+			}
 		}
 		if err != nil {
+			if context.Cause(ctx) == errDownloadStalled {
+				return errDownloadStalled
+			}
 			if err == io.EOF {
-				task.isCompleted = true
-				break
+				return io.ErrUnexpectedEOF
 			}
-			log.Printf("任务%d读取响应错误！%s", task.taskID, err)
-			return
+			return err
+		}
+	}
+}
+
+// splitLargestTask hands the second half of the largest unfinished chunk to a new task
+func (fd *FileDownloader) splitLargestTask() *DownloadTask {
+	if !fd.IsMultiPart {
+		return nil
+	}
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	var largest *DownloadTask
+	var largestRemaining int64
+	for _, task := range fd.DownloadTaskList {
+		if task.isCompleted {
+			continue
 		}
+		remaining := task.rangeEnd - (task.rangeStart + task.downloadedSize) + 1
+		if remaining > largestRemaining {
+			largest = task
+			largestRemaining = remaining
+		}
+	}
+	if largest == nil || largestRemaining < 2*minSplitSize {
+		return nil
 	}
+	mid := largest.rangeStart + largest.downloadedSize + largestRemaining/2
+	task := &DownloadTask{
+		taskID:     len(fd.DownloadTaskList),
+		rangeStart: mid,
+		rangeEnd:   largest.rangeEnd,
+	}
+	largest.rangeEnd = mid - 1
+	fd.DownloadTaskList = append(fd.DownloadTaskList, task)
+	return task
 }
 
 func (fd *FileDownloader) Start() error {
 	err := fd.init()
 	if err != nil {
+		if fd.ctx.Err() != nil {
+			return context.Cause(fd.ctx)
+		}
 		return err
 	}
+	defer fd.File.Close()
 	fd.createDownloadTasks()
 	fd.startDownload()
-	defer fd.File.Close()
+	if !fd.finishJournal() {
+		if fd.ctx.Err() != nil {
+			return context.Cause(fd.ctx)
+		}
+		if fd.err != nil {
+			return fd.err
+		}
+	}
+	if err := fd.verify(); err != nil {
+		return fmt.Errorf("文件校验失败: %w", err)
+	}
+	if err := fd.File.Close(); err != nil {
+		return err
+	}
+	commitHash := fd.Sha256
+	if fd.DecodeStr != "" {
+		// an existing file is never reused for content that is decrypted in place afterwards
+		commitHash = ""
+	}
+	fileName, err := commitPart(fd.FileName, commitHash)
+	if err != nil {
+		return err
+	}
+	fd.FileName = fileName
 	return nil
 }
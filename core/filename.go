@@ -0,0 +1,204 @@
+package core
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxNameBytes is the longest file name most file systems accept
+const maxNameBytes = 255
+
+var placeholderPattern = regexp.MustCompile(`\{([a-zA-Z]+)(?:\.([^{}:]+))?(?::([^{}]*))?\}`)
+
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// filenameTemplate is the configured template, without one the legacy file name settings are turned into a template
+func filenameTemplate() string {
+	if globalConfig.FilenameTemplate != "" {
+		return globalConfig.FilenameTemplate
+	}
+	fileLen := globalConfig.FilenameLen
+	if fileLen <= 0 {
+		fileLen = 10
+	}
+	template := "{description:" + strconv.Itoa(fileLen) + "}"
+	if globalConfig.FilenameTime {
+		template += "_{date}"
+	}
+	return template + "{ext}"
+}
+
+// cleanDescription strips the markup, topics and punctuation WeChat descriptions carry
+func cleanDescription(description string) string {
+	// 1. 先移除 HTML 标签
+	description = regexp.MustCompile(`<[^>]*>`).ReplaceAllString(description, "")
+	// 2. 移除 HTML 实体字符
+	description = regexp.MustCompile(`&[^;]+;`).ReplaceAllString(description, "")
+	// 3. 移除话题标签（包括前中后位置的话题，支持无空格分隔）
+	description = regexp.MustCompile(`#[^#\s]+`).ReplaceAllString(description, "")
+	// 4. 移除多余空格（包括中间的空格）
+	description = regexp.MustCompile(`\s+`).ReplaceAllString(description, "")
+	// 5. 处理特殊字符和空格相关的问号
+	description = regexp.MustCompile(`([^\p{Han}\p{Latin}])[?？]|[?？]([^\p{Han}\p{Latin}])|(%20|\s)[?？]|[?？](%20|\s)`).ReplaceAllString(description, "$1$2")
+	// 6. 移除文件系统不支持的字符
+	fileName := regexp.MustCompile(`[<>:"/\\|*]`).ReplaceAllString(description, "")
+	// 7. 移除所有空格和转义空格
+	fileName = strings.ReplaceAll(fileName, "%20", "")
+	fileName = regexp.MustCompile(`\s+`).ReplaceAllString(fileName, "")
+	// 8. 移除末尾标点
+	fileName = strings.TrimRight(fileName, "！!。，,?？")
+	fileName = strings.TrimSpace(fileName)
+	// 9. 处理问号：如果包含疑问词则保留问号
+	if strings.ContainsAny(fileName, "吗么呢") {
+		if strings.HasSuffix(fileName, "?") || strings.HasSuffix(fileName, "？") {
+			fileName = strings.TrimRight(fileName, "?？") + "?"
+		}
+	} else {
+		fileName = strings.TrimRight(fileName, "?？")
+	}
+	// 10. 移除其他末尾标点
+	return strings.TrimRight(fileName, "！!。，,")
+}
+
+// placeholderValue renders one placeholder, arg is a length for text fields and a time layout for dates
+func placeholderValue(mediaInfo MediaInfo, name, key, arg string, now time.Time) (string, bool) {
+	var value string
+	switch strings.ToLower(name) {
+	case "id":
+		value = mediaInfo.Id
+	case "url":
+		value = mediaInfo.Url
+	case "urlsign", "md5":
+		if value = mediaInfo.UrlSign; value == "" {
+			value = Md5(mediaInfo.Url)
+		}
+	case "domain":
+		value = mediaInfo.Domain
+	case "host":
+		if u, err := url.Parse(mediaInfo.Url); err == nil {
+			value = u.Hostname()
+		}
+	case "name":
+		if u, err := url.Parse(mediaInfo.Url); err == nil {
+			value = strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path))
+		}
+	case "classify":
+		value = mediaInfo.Classify
+	case "ext", "suffix":
+		value = mediaInfo.Suffix
+	case "size":
+		value = mediaInfo.Size
+	case "contenttype":
+		value = strings.ReplaceAll(MediaType(mediaInfo.ContentType), "/", "-")
+	case "description":
+		// resources without a description are named after the whole hash of their url, the length only limits a description
+		if value = cleanDescription(mediaInfo.Description); value == "" {
+			return Md5(mediaInfo.Url), true
+		}
+	case "hash":
+		value = mediaInfo.Hash
+	case "status":
+		value = mediaInfo.Status
+	case "other":
+		value = mediaInfo.OtherData[key]
+	case "date":
+		if arg == "" {
+			arg = "20060102150405"
+		}
+		return now.Format(arg), true
+	default:
+		return "", false
+	}
+	if length, err := strconv.Atoi(arg); err == nil && length > 0 {
+		if runes := []rune(value); len(runes) > length {
+			value = string(runes[:length])
+		}
+	}
+	return value, true
+}
+
+// sanitizeName makes one path component valid on the current OS
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7F || r == '/' || r == '\\' {
+			return '_'
+		}
+		if runtime.GOOS == "windows" && strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		if runtime.GOOS == "darwin" && r == ':' {
+			return '_'
+		}
+		return r
+	}, name)
+	if runtime.GOOS == "windows" {
+		name = strings.TrimRight(name, ". ")
+		base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+		if windowsReservedNames[base] {
+			name = "_" + name
+		}
+	}
+	name = strings.TrimSpace(name)
+	if name == "." || name == ".." {
+		name = "_"
+	}
+	return name
+}
+
+// truncateName shortens name to the byte limit of file systems, the extension is kept
+func truncateName(name string, ext string) string {
+	if len(name) <= maxNameBytes {
+		return name
+	}
+	base := []rune(strings.TrimSuffix(name, ext))
+	for len(string(base))+len(ext) > maxNameBytes && len(base) > 0 {
+		base = base[:len(base)-1]
+	}
+	return string(base) + ext
+}
+
+// RenderFilename fills a template such as {domain}/{classify}/{date:2006-01-02}/{description:40}_{id}{ext}
+// and returns a path relative to the save directory, a slash in the template starts a subdirectory
+func RenderFilename(template string, mediaInfo MediaInfo, now time.Time) string {
+	if template == "" {
+		template = "{description:10}_{date}{ext}"
+	}
+	components := strings.Split(strings.ReplaceAll(template, "\\", "/"), "/")
+	var parts []string
+	for i, component := range components {
+		last := i == len(components)-1
+		rendered := placeholderPattern.ReplaceAllStringFunc(component, func(match string) string {
+			groups := placeholderPattern.FindStringSubmatch(match)
+			value, ok := placeholderValue(mediaInfo, groups[1], groups[2], groups[3], now)
+			if !ok {
+				return match
+			}
+			// values never add directories of their own
+			return strings.NewReplacer("/", "_", "\\", "_").Replace(value)
+		})
+		if !last {
+			if rendered = sanitizeName(rendered); rendered != "" && rendered != "_" {
+				parts = append(parts, truncateName(rendered, ""))
+			}
+			continue
+		}
+		ext := path.Ext(rendered)
+		if ext != mediaInfo.Suffix {
+			ext = ""
+		}
+		if strings.Trim(strings.TrimSuffix(rendered, ext), "_-. ") == "" {
+			rendered = Md5(mediaInfo.Url) + ext
+		}
+		parts = append(parts, truncateName(sanitizeName(rendered), ext))
+	}
+	return path.Join(parts...)
+}
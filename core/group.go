@@ -0,0 +1,210 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxPlaylistSize bounds how much of a playlist is read to learn which segments belong to it
+const maxPlaylistSize = 4 << 20
+
+// GroupRule names the query parameters that do not identify a resource on a domain, requests differing only in them are one resource
+type GroupRule struct {
+	Domain       string   `json:"Domain"`
+	IgnoreParams []string `json:"IgnoreParams"`
+}
+
+var defaultGroupRules = []GroupRule{
+	{
+		Domain:       "*",
+		IgnoreParams: []string{"range", "bytestart", "byteend", "_"},
+	},
+}
+
+func groupRules() []GroupRule {
+	if len(globalConfig.GroupRules) == 0 {
+		return defaultGroupRules
+	}
+	return globalConfig.GroupRules
+}
+
+// ignoredParams collects the parameters of every rule matching host, unlike header rules a domain rule adds to "*" instead of replacing it
+func ignoredParams(host string) []string {
+	var params []string
+	for _, rule := range groupRules() {
+		domain := strings.ToLower(strings.TrimPrefix(rule.Domain, "*."))
+		if domain == "*" || host == domain || strings.HasSuffix(host, "."+domain) {
+			params = append(params, rule.IgnoreParams...)
+		}
+	}
+	return params
+}
+
+// groupKey identifies the object a request addresses, the scheme and the ignored query parameters do not count
+func groupKey(u *url.URL) string {
+	query := u.Query()
+	patterns := ignoredParams(strings.ToLower(u.Hostname()))
+	for name := range query {
+		if matchPattern(patterns, name) {
+			query.Del(name)
+		}
+	}
+	return Md5(strings.ToLower(u.Host) + u.EscapedPath() + "?" + query.Encode())
+}
+
+// objectSize is the size of the whole object, a partial response reports it after the slash of Content-Range
+func objectSize(resp *http.Response) float64 {
+	if resp.StatusCode == http.StatusPartialContent {
+		contentRange := resp.Header.Get("Content-Range")
+		if i := strings.LastIndex(contentRange, "/"); i != -1 {
+			if value, err := strconv.ParseFloat(contentRange[i+1:], 64); err == nil {
+				return value
+			}
+		}
+	}
+	value, _ := strconv.ParseFloat(resp.Header.Get("Content-Length"), 64)
+	return value
+}
+
+// playlistBody keeps a copy of a playlist while the client reads it and parses the copy once it is complete,
+// a playlist larger than maxPlaylistSize is passed on without being parsed
+type playlistBody struct {
+	body  io.ReadCloser
+	buf   bytes.Buffer
+	over  bool
+	done  bool
+	parse func(body []byte)
+}
+
+func (b *playlistBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 && !b.over {
+		if b.buf.Len()+n > maxPlaylistSize {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.done && !b.over {
+		b.done = true
+		b.parse(b.buf.Bytes())
+	}
+	return n, err
+}
+
+func (b *playlistBody) Close() error {
+	return b.body.Close()
+}
+
+// watchPlaylist folds the variants and segments of a playlist passing through the proxy into owner,
+// they are known once the client has received the whole playlist
+func watchPlaylist(resp *http.Response, classify, owner string) {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	rawUrl := resp.Request.URL.String()
+	resp.Body = &playlistBody{
+		body: resp.Body,
+		parse: func(body []byte) {
+			members := playlistMembers(body, encoding, rawUrl, classify)
+			if len(members) == 0 {
+				return
+			}
+			resourceOnce.markMu.Lock()
+			defer resourceOnce.markMu.Unlock()
+			resourceOnce.addGroupMembers(owner, members...)
+		},
+	}
+}
+
+// playlistMembers returns the urls of the variants and segments of a playlist
+func playlistMembers(body []byte, encoding, rawUrl, classify string) []string {
+	if strings.EqualFold(encoding, "gzip") {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil
+		}
+		if body, err = io.ReadAll(io.LimitReader(reader, maxPlaylistSize)); err != nil {
+			return nil
+		}
+	}
+
+	var members []string
+	addPlaylist := func(playlist *M3u8Playlist) {
+		for _, segment := range playlist.Segments {
+			members = append(members, segment.Url)
+			if segment.Map != nil {
+				members = append(members, segment.Map.Url)
+			}
+		}
+	}
+	switch classify {
+	case "m3u8":
+		playlist, err := ParseM3u8(string(body), rawUrl)
+		if err != nil {
+			return nil
+		}
+		for _, variant := range playlist.Variants {
+			members = append(members, variant.Url)
+		}
+		addPlaylist(playlist)
+	case "mpd":
+		manifest, err := ParseMpd(body, rawUrl)
+		if err != nil {
+			return nil
+		}
+		for i := range manifest.Representations {
+			if playlist, err := manifest.Segments(&manifest.Representations[i]); err == nil {
+				addPlaylist(playlist)
+			}
+		}
+	}
+	return members
+}
+
+// groupOwner returns the sign of the listed resource a request belongs to, the caller holds markMu
+func (r *Resource) groupOwner(key string) (string, bool) {
+	owner, ok := r.groups[key]
+	return owner, ok
+}
+
+// newGroup lists sign as the owner of key, a playlist owns no segment of its own, the caller holds markMu
+func (r *Resource) newGroup(sign, key string, segments int) {
+	r.groups[key] = sign
+	r.segments[sign] = segments
+}
+
+// addGroupMembers folds later requests for urls into owner, the caller holds markMu
+func (r *Resource) addGroupMembers(owner string, urls ...string) {
+	for _, rawUrl := range urls {
+		u, err := url.Parse(rawUrl)
+		if err != nil {
+			continue
+		}
+		if key := groupKey(u); r.groups[key] == "" {
+			r.groups[key] = owner
+		}
+	}
+}
+
+// foldSegment counts one more request folded into owner and returns the count, the caller holds markMu
+func (r *Resource) foldSegment(owner string) int {
+	r.segments[owner]++
+	return r.segments[owner]
+}
+
+func (r *Resource) removeGroup(owner string) {
+	for key, value := range r.groups {
+		if value == owner {
+			delete(r.groups, key)
+		}
+	}
+	delete(r.segments, owner)
+}
@@ -0,0 +1,472 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/elazarl/goproxy"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxRecordEntries bounds a recording session, the oldest entries are dropped first
+	maxRecordEntries = 10000
+	// maxRecordBodyBytes bounds the bodies kept by a session, the oldest bodies are dropped first
+	maxRecordBodyBytes = 256 * 1048576
+)
+
+// Har is an HTTP Archive 1.2 document
+type Har struct {
+	Log HarLog `json:"log"`
+}
+
+type HarLog struct {
+	Version string     `json:"version"`
+	Creator HarCreator `json:"creator"`
+	Entries []HarEntry `json:"entries"`
+}
+
+type HarCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HarEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HarRequest  `json:"request"`
+	Response        HarResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HarTimings  `json:"timings"`
+
+	// bodyBytes is what the bodies of a recorded entry count against the session budget
+	bodyBytes int64
+	// dropped entries no longer count, a body finishing after that is not kept
+	dropped bool
+}
+
+type HarRequest struct {
+	Method      string         `json:"method"`
+	Url         string         `json:"url"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []HarNameValue `json:"cookies"`
+	Headers     []HarNameValue `json:"headers"`
+	QueryString []HarNameValue `json:"queryString"`
+	PostData    *HarPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HarResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []HarNameValue `json:"cookies"`
+	Headers     []HarNameValue `json:"headers"`
+	Content     HarContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HarNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HarPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type HarContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type HarTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// TrafficRecorder keeps the requests passing through the proxy while recording is on
+type TrafficRecorder struct {
+	mu        sync.Mutex
+	entries   []*HarEntry
+	bodyBytes int64
+}
+
+// recordState follows one request from the request hook to the end of its response body
+type recordState struct {
+	started time.Time
+	body    *limitedBuffer
+}
+
+// limitedBuffer keeps the first limit bytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int64
+	size      int64
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.size += int64(len(p))
+	if room := b.limit - int64(b.Len()); room > 0 {
+		if int64(len(p)) > room {
+			b.Buffer.Write(p[:room])
+			b.truncated = true
+		} else {
+			b.Buffer.Write(p)
+		}
+	} else if len(p) > 0 {
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+// recordBody copies what the client reads into the entry, the entry is completed when the body ends
+type recordBody struct {
+	body     io.ReadCloser
+	buffer   *limitedBuffer
+	recorder *TrafficRecorder
+	entry    *HarEntry
+	received time.Time
+	done     bool
+}
+
+func initRecorder() *TrafficRecorder {
+	if recorderOnce == nil {
+		recorderOnce = &TrafficRecorder{}
+	}
+	return recorderOnce
+}
+
+func recordBodyLimit() int64 {
+	return int64(globalConfig.RecordBodyMaxSize) * 1048576
+}
+
+func harHeaders(header http.Header) []HarNameValue {
+	values := make([]HarNameValue, 0, len(header))
+	for name, items := range header {
+		for _, value := range items {
+			values = append(values, HarNameValue{Name: name, Value: value})
+		}
+	}
+	return values
+}
+
+func harCookies(cookies []*http.Cookie) []HarNameValue {
+	values := make([]HarNameValue, 0, len(cookies))
+	for _, cookie := range cookies {
+		values = append(values, HarNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+	return values
+}
+
+func harQuery(u *url.URL) []HarNameValue {
+	values := make([]HarNameValue, 0)
+	for name, items := range u.Query() {
+		for _, value := range items {
+			values = append(values, HarNameValue{Name: name, Value: value})
+		}
+	}
+	return values
+}
+
+// harText stores a body as text when it is valid UTF-8 and as base64 otherwise
+func harText(data []byte) (string, string) {
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	return base64.StdEncoding.EncodeToString(data), "base64"
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// request notes when a request started and keeps the start of its body
+func (t *TrafficRecorder) request(r *http.Request, ctx *goproxy.ProxyCtx) {
+	if !globalConfig.RecordTraffic || ctx == nil {
+		return
+	}
+	state := &recordState{started: time.Now()}
+	if limit := recordBodyLimit(); limit > 0 && r.Body != nil && r.Body != http.NoBody {
+		state.body = &limitedBuffer{limit: limit}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, state.body), r.Body}
+	}
+	ctx.UserData = state
+}
+
+// response adds an entry for resp, its content is filled in once the client has read the body
+func (t *TrafficRecorder) response(resp *http.Response, ctx *goproxy.ProxyCtx) {
+	if !globalConfig.RecordTraffic || resp == nil || resp.Request == nil {
+		return
+	}
+	now := time.Now()
+	var state *recordState
+	if ctx != nil {
+		state, _ = ctx.UserData.(*recordState)
+	}
+	if state == nil {
+		state = &recordState{started: now}
+	}
+	request := resp.Request
+	entry := &HarEntry{
+		StartedDateTime: state.started.Format(time.RFC3339Nano),
+		Request: HarRequest{
+			Method:      request.Method,
+			Url:         request.URL.String(),
+			HttpVersion: request.Proto,
+			Cookies:     harCookies(request.Cookies()),
+			Headers:     harHeaders(request.Header),
+			QueryString: harQuery(request.URL),
+			HeadersSize: -1,
+			BodySize:    request.ContentLength,
+		},
+		Response: HarResponse{
+			Status:      resp.StatusCode,
+			StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+			HttpVersion: resp.Proto,
+			Cookies:     harCookies(resp.Cookies()),
+			Headers:     harHeaders(resp.Header),
+			Content: HarContent{
+				Size:     resp.ContentLength,
+				MimeType: resp.Header.Get("Content-Type"),
+			},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    resp.ContentLength,
+		},
+		Timings: HarTimings{Wait: milliseconds(now.Sub(state.started))},
+	}
+	if state.body != nil {
+		text, encoding := harText(state.body.Bytes())
+		entry.Request.PostData = &HarPostData{MimeType: request.Header.Get("Content-Type"), Text: text}
+		if encoding != "" || state.body.truncated {
+			entry.Request.PostData.Comment = "truncated or binary body, " + strconv.FormatInt(state.body.size, 10) + " bytes"
+		}
+		entry.Request.BodySize = state.body.size
+	}
+	entry.Time = entry.Timings.Wait
+	t.add(entry)
+
+	if resp.Body == nil || resp.Body == http.NoBody || recordBodyLimit() <= 0 {
+		return
+	}
+	resp.Body = &recordBody{
+		body:     resp.Body,
+		buffer:   &limitedBuffer{limit: recordBodyLimit()},
+		recorder: t,
+		entry:    entry,
+		received: now,
+	}
+}
+
+func (t *TrafficRecorder) add(entry *HarEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.entries) >= maxRecordEntries {
+		t.drop(t.entries[0])
+		t.entries = t.entries[1:]
+	}
+	t.entries = append(t.entries, entry)
+	if entry.Request.PostData != nil {
+		t.count(entry, int64(len(entry.Request.PostData.Text)))
+	}
+}
+
+func (t *TrafficRecorder) drop(entry *HarEntry) {
+	t.bodyBytes -= entry.bodyBytes
+	entry.bodyBytes = 0
+	entry.dropped = true
+}
+
+// count adds the size of a body kept for entry and drops the oldest bodies while the session is over its budget
+func (t *TrafficRecorder) count(entry *HarEntry, size int64) {
+	if entry.dropped || size == 0 {
+		return
+	}
+	entry.bodyBytes += size
+	t.bodyBytes += size
+	for _, oldest := range t.entries {
+		if t.bodyBytes <= maxRecordBodyBytes {
+			break
+		}
+		if oldest.bodyBytes == 0 {
+			continue
+		}
+		t.bodyBytes -= oldest.bodyBytes
+		oldest.bodyBytes = 0
+		if oldest.Request.PostData != nil && oldest.Request.PostData.Text != "" {
+			oldest.Request.PostData = &HarPostData{MimeType: oldest.Request.PostData.MimeType, Comment: "body dropped, the recording is over its memory budget"}
+		}
+		if oldest.Response.Content.Text != "" {
+			oldest.Response.Content.Text, oldest.Response.Content.Encoding = "", ""
+			oldest.Response.Content.Comment = "body dropped, the recording is over its memory budget"
+		}
+	}
+}
+
+func (b *recordBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		_, _ = b.buffer.Write(p[:n])
+	}
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *recordBody) Close() error {
+	b.finish()
+	return b.body.Close()
+}
+
+func (b *recordBody) finish() {
+	if b.done {
+		return
+	}
+	b.done = true
+	b.recorder.mu.Lock()
+	defer b.recorder.mu.Unlock()
+	content := &b.entry.Response.Content
+	content.Size = b.buffer.size
+	b.entry.Response.BodySize = b.buffer.size
+	if b.buffer.Len() > 0 && !b.buffer.truncated {
+		content.Text, content.Encoding = harText(b.buffer.Bytes())
+	} else if b.buffer.truncated {
+		content.Comment = "body larger than the recording limit"
+	}
+	if encoding := b.entry.responseHeader("Content-Encoding"); content.Text != "" && encoding != "" && encoding != "identity" {
+		content.Comment = "body is " + encoding + " encoded"
+	}
+	b.recorder.count(b.entry, int64(len(content.Text)))
+	b.entry.Timings.Receive = milliseconds(time.Since(b.received))
+	b.entry.Time = b.entry.Timings.Wait + b.entry.Timings.Receive
+}
+
+func (e *HarEntry) responseHeader(name string) string {
+	for _, header := range e.Response.Headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// Har returns the recorded session
+func (t *TrafficRecorder) Har() Har {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries := make([]HarEntry, 0, len(t.entries))
+	for _, entry := range t.entries {
+		entries = append(entries, *entry)
+	}
+	return Har{Log: HarLog{
+		Version: "1.2",
+		Creator: HarCreator{Name: appOnce.AppName, Version: appOnce.Version},
+		Entries: entries,
+	}}
+}
+
+func (t *TrafficRecorder) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries)
+}
+
+func (t *TrafficRecorder) Clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, entry := range t.entries {
+		t.drop(entry)
+	}
+	t.entries = nil
+	t.bodyBytes = 0
+}
+
+// harResponse rebuilds the response of an entry so it can be classified like live traffic
+func harResponse(entry HarEntry) (*http.Response, error) {
+	request, err := http.NewRequest(entry.Request.Method, entry.Request.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range entry.Request.Headers {
+		// HTTP/2 pseudo headers are not headers of the request
+		if !strings.HasPrefix(header.Name, ":") {
+			request.Header.Add(header.Name, header.Value)
+		}
+	}
+	resp := &http.Response{
+		Status:     strconv.Itoa(entry.Response.Status) + " " + entry.Response.StatusText,
+		StatusCode: entry.Response.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Request:    request,
+	}
+	for _, header := range entry.Response.Headers {
+		if !strings.HasPrefix(header.Name, ":") {
+			resp.Header.Add(header.Name, header.Value)
+		}
+	}
+	content := entry.Response.Content
+	var body []byte
+	if content.Encoding == "base64" {
+		if body, err = base64.StdEncoding.DecodeString(content.Text); err != nil {
+			return nil, err
+		}
+	} else {
+		body = []byte(content.Text)
+	}
+	if len(body) > 0 {
+		// browsers export the decoded body
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		resp.ContentLength = int64(len(body))
+	} else {
+		resp.ContentLength, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+		if resp.ContentLength == 0 && content.Size > 0 {
+			resp.ContentLength = content.Size
+		}
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// ImportHar feeds the entries of a HAR document through resource detection and returns how many new resources it had
+func (p *Proxy) ImportHar(har Har) int {
+	added := 0
+	for _, entry := range har.Log.Entries {
+		resp, err := harResponse(entry)
+		if err != nil {
+			continue
+		}
+		resp, ok := p.handleResponse(resp)
+		// reading to the end completes the body capture of the resource
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if ok {
+			added++
+		}
+	}
+	return added
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// HeaderRule decides which captured request headers are replayed for a domain, names may use glob patterns such as X-*
+type HeaderRule struct {
+	Domain string   `json:"Domain"`
+	Allow  []string `json:"Allow"`
+	Deny   []string `json:"Deny"`
+}
+
+var defaultHeaderRules = []HeaderRule{
+	{
+		Domain: "*",
+		Allow:  []string{"Cookie", "Referer", "Origin", "Authorization", "User-Agent", "X-*"},
+		Deny:   []string{},
+	},
+}
+
+// skipHeaders are never captured, they describe the original connection rather than the resource
+var skipHeaders = map[string]bool{
+	"Host":                true,
+	"Connection":          true,
+	"Proxy-Connection":    true,
+	"Proxy-Authorization": true,
+	"Keep-Alive":          true,
+	"Content-Length":      true,
+	"Transfer-Encoding":   true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Upgrade":             true,
+	"Range":               true,
+	"If-Range":            true,
+	"If-Match":            true,
+	"If-None-Match":       true,
+	"If-Modified-Since":   true,
+	"Accept-Encoding":     true,
+}
+
+// CaptureHeaders copies the headers of an intercepted request that may be needed to fetch the resource again
+func CaptureHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string)
+	for name, values := range header {
+		name = http.CanonicalHeaderKey(name)
+		if skipHeaders[name] || len(values) == 0 {
+			continue
+		}
+		if name == "Cookie" {
+			headers[name] = strings.Join(values, "; ")
+		} else {
+			headers[name] = strings.Join(values, ", ")
+		}
+	}
+	return headers
+}
+
+func headerRules() []HeaderRule {
+	if len(globalConfig.HeaderRules) == 0 {
+		return defaultHeaderRules
+	}
+	return globalConfig.HeaderRules
+}
+
+// matchHeaderRule returns the rule with the longest domain matching host, "*" matches every host
+func matchHeaderRule(host string) *HeaderRule {
+	var matched *HeaderRule
+	matchedDomain := ""
+	rules := headerRules()
+	for i := range rules {
+		rule := &rules[i]
+		domain := strings.ToLower(strings.TrimPrefix(rule.Domain, "*."))
+		if domain != "*" && host != domain && !strings.HasSuffix(host, "."+domain) {
+			continue
+		}
+		if matched == nil || matchedDomain == "*" || len(domain) > len(matchedDomain) {
+			matched = rule
+			matchedDomain = domain
+		}
+	}
+	return matched
+}
+
+func matchPattern(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// credentialHeaders identify the user, the catch-all rule only sends them back to the host they were captured from
+var credentialHeaders = map[string]bool{
+	"Cookie":        true,
+	"Authorization": true,
+}
+
+func urlHost(rawUrl string) string {
+	parsedURL, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsedURL.Hostname())
+}
+
+// FilterHeaders keeps the headers captured from capturedUrl that the rules allow to be forwarded to rawUrl,
+// a rule naming the domain is needed to send credentials to another host such as a CDN
+func FilterHeaders(rawUrl, capturedUrl string, headers map[string]string) map[string]string {
+	filtered := make(map[string]string)
+	host := urlHost(rawUrl)
+	if host == "" {
+		return filtered
+	}
+	rule := matchHeaderRule(host)
+	if rule == nil {
+		return filtered
+	}
+	sameHost := host == urlHost(capturedUrl)
+	for name, value := range headers {
+		if rule.Domain == "*" && !sameHost && credentialHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		if matchPattern(rule.Allow, name) && !matchPattern(rule.Deny, name) {
+			filtered[name] = value
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,201 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HistoryEntry is one finished download, unlike the library it survives clearing the resource list
+type HistoryEntry struct {
+	Url          string `json:"Url"`
+	UrlKey       string `json:"UrlKey"`
+	ObjectId     string `json:"ObjectId"`
+	Hash         string `json:"Hash"`
+	SavePath     string `json:"SavePath"`
+	Description  string `json:"Description"`
+	DownloadedAt int64  `json:"DownloadedAt"`
+}
+
+// History indexes finished downloads by normalized url, WeChat object id and content hash,
+// entries are appended to a JSON lines file and a later entry for the same key wins
+type History struct {
+	fileName string
+	mu       sync.RWMutex
+	entries  []*HistoryEntry
+	byUrl    map[string]*HistoryEntry
+	byObject map[string]*HistoryEntry
+	byHash   map[string]*HistoryEntry
+	file     *os.File
+}
+
+func initHistory() *History {
+	if historyOnce == nil {
+		historyOnce = &History{
+			fileName: filepath.Join(appOnce.UserDir, "history.jsonl"),
+		}
+		historyOnce.reset()
+		if err := historyOnce.load(); err != nil {
+			globalLogger.Esg(err, "load history err")
+		}
+	}
+	return historyOnce
+}
+
+func (h *History) reset() {
+	h.entries = nil
+	h.byUrl = make(map[string]*HistoryEntry)
+	h.byObject = make(map[string]*HistoryEntry)
+	h.byHash = make(map[string]*HistoryEntry)
+}
+
+func (h *History) load() error {
+	if err := os.MkdirAll(filepath.Dir(h.fileName), os.ModePerm); err != nil {
+		return err
+	}
+	if file, err := os.Open(h.fileName); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16<<20)
+		for scanner.Scan() {
+			var entry HistoryEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+				h.index(&entry)
+			}
+		}
+		file.Close()
+	}
+	file, err := os.OpenFile(h.fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	h.file = file
+	return nil
+}
+
+func (h *History) index(entry *HistoryEntry) {
+	h.entries = append(h.entries, entry)
+	if entry.UrlKey != "" {
+		h.byUrl[entry.UrlKey] = entry
+	}
+	if entry.ObjectId != "" {
+		h.byObject[entry.ObjectId] = entry
+	}
+	if entry.Hash != "" {
+		h.byHash[entry.Hash] = entry
+	}
+}
+
+// historyUrlKey normalizes a url the way resources are grouped, ignored query parameters and the scheme do not count
+func historyUrlKey(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return groupKey(u)
+}
+
+// wxObjectId is the id of the WeChat Channels post a resource was captured from
+func wxObjectId(mediaInfo MediaInfo) string {
+	return mediaInfo.OtherData["wx_object_id"]
+}
+
+// Record remembers a finished download
+func (h *History) Record(mediaInfo MediaInfo) {
+	if mediaInfo.SavePath == "" {
+		return
+	}
+	entry := &HistoryEntry{
+		Url:          mediaInfo.Url,
+		UrlKey:       historyUrlKey(mediaInfo.Url),
+		ObjectId:     wxObjectId(mediaInfo),
+		Hash:         mediaInfo.Hash,
+		SavePath:     mediaInfo.SavePath,
+		Description:  mediaInfo.Description,
+		DownloadedAt: time.Now().Unix(),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// a download skipped as already done reports the earlier file again
+	if known, ok := h.byUrl[entry.UrlKey]; ok && known.SavePath == entry.SavePath && known.Hash == entry.Hash {
+		return
+	}
+	h.index(entry)
+	if h.file == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if _, err = h.file.Write(append(data, '\n')); err != nil {
+		globalLogger.Esg(err, "write history err")
+	}
+}
+
+// Lookup finds an earlier download of the resource, the object id is checked first since WeChat urls change per session
+func (h *History) Lookup(mediaInfo MediaInfo) (*HistoryEntry, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if id := wxObjectId(mediaInfo); id != "" {
+		if entry, ok := h.byObject[id]; ok {
+			return entry, true
+		}
+	}
+	if key := historyUrlKey(mediaInfo.Url); key != "" {
+		if entry, ok := h.byUrl[key]; ok {
+			return entry, true
+		}
+	}
+	return h.lookupHash(mediaInfo.Hash)
+}
+
+// LookupHash finds an earlier download with the same content
+func (h *History) LookupHash(hash string) (*HistoryEntry, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.lookupHash(hash)
+}
+
+func (h *History) lookupHash(hash string) (*HistoryEntry, bool) {
+	if hash == "" {
+		return nil, false
+	}
+	entry, ok := h.byHash[hash]
+	return entry, ok
+}
+
+// flag marks a newly sniffed resource that was downloaded before with where it was saved
+func (h *History) flag(mediaInfo *MediaInfo) {
+	if entry, ok := h.Lookup(*mediaInfo); ok {
+		mediaInfo.DownloadedPath = entry.SavePath
+	}
+}
+
+// List returns the entries newest first
+func (h *History) List() []*HistoryEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	list := make([]*HistoryEntry, 0, len(h.entries))
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		list = append(list, h.entries[i])
+	}
+	return list
+}
+
+func (h *History) Clear() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reset()
+	if h.file == nil {
+		return nil
+	}
+	if err := h.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := h.file.Seek(0, 0)
+	return err
+}
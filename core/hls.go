@@ -0,0 +1,496 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HlsSegmentsSuffix is appended to the save path for the directory holding finished segments until they are joined
+const HlsSegmentsSuffix = ".segments"
+
+var errHlsLive = errors.New("直播流不支持直接下载")
+
+type HlsDownloader struct {
+	Url              string
+	FileName         string
+	Variant          string
+	Referer          string
+	ProxyUrl         *url.URL
+	Headers          map[string]string
+	CapturedUrl      string
+	Limiter          *RateLimiter
+	Playlist         *M3u8Playlist
+	Sha256           string
+	progressCallback ProgressCallback
+	ctx              context.Context
+	client           *http.Client
+	keys             map[string][]byte
+	keysMu           sync.Mutex
+	maps             map[*M3u8Map]string
+}
+
+func NewHlsDownloader(url, filename string) *HlsDownloader {
+	return &HlsDownloader{
+		Url:      url,
+		FileName: filename,
+		keys:     make(map[string][]byte),
+		maps:     make(map[*M3u8Map]string),
+		ctx:      context.Background(),
+	}
+}
+
+// setHeaders adds the headers captured from CapturedUrl that FilterHeaders allows for the url of the request,
+// a playlist and its segments and keys may be served from different hosts
+func (hd *HlsDownloader) setHeaders(request *http.Request) {
+	request.Header.Set("User-Agent", globalConfig.UserAgent)
+	request.Header.Set("Referer", hd.Referer)
+	for name, value := range FilterHeaders(request.URL.String(), hd.CapturedUrl, hd.Headers) {
+		request.Header.Set(name, value)
+	}
+}
+
+func (hd *HlsDownloader) prepare() {
+	if hd.client != nil {
+		return
+	}
+	if hd.Referer == "" {
+		hd.Referer = BuildReferer(hd.Url)
+	}
+	hd.ProxyUrl = downloadProxyUrl()
+	hd.client = newDownloadClient(hd.ProxyUrl)
+}
+
+// fetch reads a whole resource or a byte range of it, aborting when no data arrives within the stall timeout
+func (hd *HlsDownloader) fetch(rawUrl string, byteRange *M3u8ByteRange) ([]byte, error) {
+	stallTimeout := time.Duration(globalConfig.StallTimeout) * time.Second
+	if stallTimeout <= 0 {
+		stallTimeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithCancelCause(hd.ctx)
+	defer cancel(nil)
+	watchdog := time.AfterFunc(stallTimeout, func() {
+		cancel(errDownloadStalled)
+	})
+	defer watchdog.Stop()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, rawUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	hd.setHeaders(request)
+	if byteRange != nil {
+		if byteRange.Offset < 0 || byteRange.Length <= 0 {
+			return nil, fmt.Errorf("无效的分段范围: %d@%d", byteRange.Length, byteRange.Offset)
+		}
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", byteRange.Offset, byteRange.Offset+byteRange.Length-1))
+	}
+	resp, err := hd.client.Do(request)
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			return nil, cause
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("服务器返回非200状态码: %d", resp.StatusCode)
+	}
+
+	var buffer bytes.Buffer
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			watchdog.Reset(stallTimeout)
+			if err := waitLimit(ctx, hd.Limiter, n); err != nil {
+				return nil, context.Cause(ctx)
+			}
+			buffer.Write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if cause := context.Cause(ctx); cause != nil {
+				return nil, cause
+			}
+			return nil, err
+		}
+	}
+	data := buffer.Bytes()
+	if byteRange != nil && resp.StatusCode == http.StatusOK {
+		// the server ignored the range and sent the whole resource
+		if int64(len(data)) < byteRange.Offset+byteRange.Length {
+			return nil, io.ErrUnexpectedEOF
+		}
+		data = data[byteRange.Offset : byteRange.Offset+byteRange.Length]
+	}
+	return data, nil
+}
+
+// fetchRetry retries fetch with exponential backoff until the attempts run out or the download is stopped
+func (hd *HlsDownloader) fetchRetry(rawUrl string, byteRange *M3u8ByteRange) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt <= globalConfig.RetryCount; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(retryDelay(attempt)):
+			case <-hd.ctx.Done():
+				return nil, context.Cause(hd.ctx)
+			}
+		}
+		var data []byte
+		data, err = hd.fetch(rawUrl, byteRange)
+		if err == nil {
+			return data, nil
+		}
+		if hd.ctx.Err() != nil {
+			return nil, context.Cause(hd.ctx)
+		}
+		globalLogger.Warn().Msgf("hls fetch %s failed (attempt %d): %v", rawUrl, attempt+1, err)
+	}
+	return nil, err
+}
+
+func (hd *HlsDownloader) fetchPlaylist(rawUrl string) (*M3u8Playlist, error) {
+	data, err := hd.fetchRetry(rawUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ParseM3u8(string(data), rawUrl)
+}
+
+// Variants lists the renditions of a master playlist, a media playlist has none
+func (hd *HlsDownloader) Variants() ([]M3u8Variant, error) {
+	hd.prepare()
+	playlist, err := hd.fetchPlaylist(hd.Url)
+	if err != nil {
+		return nil, err
+	}
+	return playlist.Variants, nil
+}
+
+// selectVariant picks the variant with the given url, or the highest bandwidth one
+func selectVariant(variants []M3u8Variant, want string) M3u8Variant {
+	best := variants[0]
+	for _, variant := range variants {
+		if want != "" && variant.Url == want {
+			return variant
+		}
+		if variant.Bandwidth > best.Bandwidth {
+			best = variant
+		}
+	}
+	return best
+}
+
+// loadPlaylist resolves the media playlist to download, following a master playlist to the chosen variant
+func (hd *HlsDownloader) loadPlaylist() error {
+	playlist, err := hd.fetchPlaylist(hd.Url)
+	if err != nil {
+		return err
+	}
+	if playlist.IsMaster {
+		if len(playlist.Variants) == 0 {
+			return fmt.Errorf("m3u8 未包含可下载的码流")
+		}
+		variant := selectVariant(playlist.Variants, hd.Variant)
+		if playlist, err = hd.fetchPlaylist(variant.Url); err != nil {
+			return err
+		}
+	}
+	if !playlist.EndList {
+		return errHlsLive
+	}
+	if len(playlist.Segments) == 0 {
+		return fmt.Errorf("m3u8 未包含分片")
+	}
+	hd.Playlist = playlist
+	return nil
+}
+
+// key fetches the AES-128 key of a segment once and caches it
+func (hd *HlsDownloader) key(key *M3u8Key) ([]byte, error) {
+	if key.Method != "AES-128" {
+		return nil, fmt.Errorf("不支持的加密方式: %s", key.Method)
+	}
+	hd.keysMu.Lock()
+	defer hd.keysMu.Unlock()
+	if data, ok := hd.keys[key.Url]; ok {
+		return data, nil
+	}
+	data, err := hd.fetchRetry(key.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 16 {
+		return nil, fmt.Errorf("密钥长度错误: %d", len(data))
+	}
+	hd.keys[key.Url] = data
+	return data, nil
+}
+
+// decrypt reverses AES-128-CBC, without an explicit IV the media sequence number is used
+func (hd *HlsDownloader) decrypt(segment *M3u8Segment, data []byte) ([]byte, error) {
+	key, err := hd.key(segment.Key)
+	if err != nil {
+		return nil, err
+	}
+	iv := segment.Key.Iv
+	if iv == nil {
+		iv = make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], uint64(segment.Sequence))
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("分片长度不是分组长度的整数倍: %d", len(data))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	padding := int(data[len(data)-1])
+	if padding > 0 && padding <= aes.BlockSize && padding <= len(data) {
+		data = data[:len(data)-padding]
+	}
+	return data, nil
+}
+
+func (hd *HlsDownloader) segmentsDir() string {
+	return hd.FileName + HlsSegmentsSuffix
+}
+
+func (hd *HlsDownloader) segmentPath(index int) string {
+	return filepath.Join(hd.segmentsDir(), fmt.Sprintf("%06d.seg", index))
+}
+
+// writeFile writes through a temporary name so an interrupted write never looks finished
+func writeFile(fileName string, data []byte) error {
+	if err := os.WriteFile(fileName+PartSuffix, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fileName+PartSuffix, fileName)
+}
+
+// downloadMaps stores every distinct initialization section of a fragmented MP4 stream
+func (hd *HlsDownloader) downloadMaps() error {
+	for _, segment := range hd.Playlist.Segments {
+		if segment.Map == nil {
+			continue
+		}
+		if _, ok := hd.maps[segment.Map]; ok {
+			continue
+		}
+		fileName := filepath.Join(hd.segmentsDir(), fmt.Sprintf("init%d.mp4", len(hd.maps)))
+		hd.maps[segment.Map] = fileName
+		if FileExist(fileName) {
+			continue
+		}
+		data, err := hd.fetchRetry(segment.Map.Url, segment.Map.ByteRange)
+		if err != nil {
+			return err
+		}
+		if err = writeFile(fileName, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hd *HlsDownloader) downloadSegment(index int, segment *M3u8Segment) (int64, error) {
+	fileName := hd.segmentPath(index)
+	if info, err := os.Stat(fileName); err == nil {
+		return info.Size(), nil
+	}
+	data, err := hd.fetchRetry(segment.Url, segment.ByteRange)
+	if err != nil {
+		return 0, err
+	}
+	if segment.Key != nil {
+		if data, err = hd.decrypt(segment, data); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(data)), writeFile(fileName, data)
+}
+
+// startDownload fetches the segments with TaskNumber workers, segments finished by an earlier run are kept
+func (hd *HlsDownloader) startDownload() error {
+	segments := hd.Playlist.Segments
+	workers := max(1, min(globalConfig.TaskNumber, len(segments)))
+	jobs := make(chan int)
+	progressChan := make(chan int64)
+	var (
+		errMu    sync.Mutex
+		firstErr error
+	)
+	waitGroup := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for index := range jobs {
+				size, err := hd.downloadSegment(index, segments[index])
+				if err != nil {
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("分片%d下载失败: %w", index, err)
+					}
+					errMu.Unlock()
+					continue
+				}
+				progressChan <- size
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for index := range segments {
+			select {
+			case jobs <- index:
+			case <-hd.ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		waitGroup.Wait()
+		close(progressChan)
+	}()
+
+	var (
+		speed          float64
+		downloaded     int64
+		finished       int
+		lastDownloaded int64
+	)
+	lastTime := time.Now()
+	for size := range progressChan {
+		downloaded += size
+		finished++
+		now := time.Now()
+		elapsed := now.Sub(lastTime)
+		if elapsed < progressInterval && finished < len(segments) {
+			continue
+		}
+		instant := float64(downloaded-lastDownloaded) / elapsed.Seconds()
+		if speed == 0 {
+			speed = instant
+		} else {
+			speed = 0.3*instant + 0.7*speed
+		}
+		lastTime = now
+		lastDownloaded = downloaded
+		hd.emitProgress(downloaded, finished, speed)
+	}
+
+	if hd.ctx.Err() != nil {
+		return context.Cause(hd.ctx)
+	}
+	return firstErr
+}
+
+// emitProgress reports progress by segments, the total size is extrapolated from the finished ones
+func (hd *HlsDownloader) emitProgress(downloaded int64, finished int, speed float64) {
+	if hd.progressCallback == nil || finished == 0 {
+		return
+	}
+	count := len(hd.Playlist.Segments)
+	total := downloaded * int64(count) / int64(finished)
+	progress := DownloadProgress{
+		Downloaded: downloaded,
+		Total:      total,
+		Percent:    float64(finished) * 100 / float64(count),
+		Speed:      int64(speed),
+		Eta:        -1,
+	}
+	if speed > 0 {
+		progress.Eta = int64(float64(total-downloaded) / speed)
+	}
+	hd.progressCallback(progress)
+}
+
+// join concatenates the segments in playlist order, writing an initialization section whenever it changes
+func (hd *HlsDownloader) join() error {
+	file, err := os.Create(hd.FileName + PartSuffix)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	writer := io.MultiWriter(file, hash)
+
+	var currentMap *M3u8Map
+	for index, segment := range hd.Playlist.Segments {
+		if segment.Map != nil && segment.Map != currentMap {
+			currentMap = segment.Map
+			if err := appendFile(writer, hd.maps[segment.Map]); err != nil {
+				return err
+			}
+		}
+		if err := appendFile(writer, hd.segmentPath(index)); err != nil {
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	hd.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	hd.FileName, err = commitPart(hd.FileName, hd.Sha256)
+	return err
+}
+
+func appendFile(writer io.Writer, fileName string) error {
+	source, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	_, err = io.Copy(writer, source)
+	return err
+}
+
+func (hd *HlsDownloader) Start() error {
+	hd.prepare()
+	if err := hd.loadPlaylist(); err != nil {
+		return err
+	}
+	ext := ".ts"
+	if hd.Playlist.Segments[0].Map != nil {
+		ext = ".mp4"
+	}
+	hd.FileName = strings.TrimSuffix(hd.FileName, filepath.Ext(hd.FileName)) + ext
+	return hd.download()
+}
+
+// download fetches the segments of the loaded playlist and joins them into FileName
+func (hd *HlsDownloader) download() error {
+	if err := os.MkdirAll(hd.segmentsDir(), os.ModePerm); err != nil {
+		return err
+	}
+	if err := hd.downloadMaps(); err != nil {
+		return err
+	}
+	if err := hd.startDownload(); err != nil {
+		return err
+	}
+	if err := hd.join(); err != nil {
+		return err
+	}
+	return os.RemoveAll(hd.segmentsDir())
+}
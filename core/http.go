@@ -11,8 +11,10 @@ import (
 	"net/http"
 	"net/url"
 	"os/exec"
+	"path/filepath"
 	sysRuntime "runtime"
 	"strings"
+	"time"
 )
 
 type ResponseData struct {
@@ -38,12 +40,13 @@ func (h *HttpServer) run() {
 	fmt.Println("服务已启动，监听 http://" + globalConfig.Host + ":" + globalConfig.Port)
 	if err := http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Host == "127.0.0.1:"+globalConfig.Port && strings.Contains(r.URL.Path, "/cert") {
+			publicCrt, _ := appOnce.ca()
 			w.Header().Set("Content-Type", "application/x-x509-ca-data")
 			w.Header().Set("Content-Disposition", "attachment;filename=res-downloader-public.crt")
 			w.Header().Set("Content-Transfer-Encoding", "binary")
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(appOnce.PublicCrt)))
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(publicCrt)))
 			w.WriteHeader(http.StatusOK)
-			_, err = io.Copy(w, io.NopCloser(bytes.NewReader(appOnce.PublicCrt)))
+			_, err = io.Copy(w, io.NopCloser(bytes.NewReader(publicCrt)))
 		} else {
 			proxyOnce.Proxy.ServeHTTP(w, r) // 代理
 		}
@@ -261,6 +264,77 @@ func (h *HttpServer) setConfig(w http.ResponseWriter, r *http.Request) {
 	h.writeJson(w, ResponseData{Code: 1})
 }
 
+func (h *HttpServer) caRegenerate(w http.ResponseWriter, r *http.Request) {
+	if err := appOnce.RegenerateCa(); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	h.writeJson(w, ResponseData{
+		Code: 1,
+		Data: map[string]interface{}{
+			"fingerprint": appOnce.caFingerprint(),
+		},
+	})
+}
+
+func (h *HttpServer) mitmCheck(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Host string `json:"host"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Host == "" {
+		h.writeJson(w, ResponseData{Code: 0, Message: "请输入域名"})
+		return
+	}
+	host := data.Host
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	h.writeJson(w, ResponseData{Code: 1, Data: EvaluateMitm(host)})
+}
+
+func (h *HttpServer) mitmHosts(w http.ResponseWriter, r *http.Request) {
+	h.writeJson(w, ResponseData{Code: 1, Data: proxyOnce.skipped.list()})
+}
+
+func (h *HttpServer) tlsStats(w http.ResponseWriter, r *http.Request) {
+	h.writeJson(w, ResponseData{Code: 1, Data: proxyOnce.leaves.stats()})
+}
+
+func (h *HttpServer) siteHandlers(w http.ResponseWriter, r *http.Request) {
+	h.writeJson(w, ResponseData{Code: 1, Data: siteInfos()})
+}
+
+// harExport returns the recorded session as a HAR document, the frontend saves it
+func (h *HttpServer) harExport(w http.ResponseWriter, r *http.Request) {
+	har := recorderOnce.Har()
+	if len(har.Log.Entries) == 0 {
+		h.writeJson(w, ResponseData{Code: 0, Message: "暂无流量记录，请先在设置中开启流量记录"})
+		return
+	}
+	h.writeJson(w, ResponseData{Code: 1, Data: har})
+}
+
+// harImport takes a HAR document in the request body
+func (h *HttpServer) harImport(w http.ResponseWriter, r *http.Request) {
+	var har Har
+	if err := json.NewDecoder(r.Body).Decode(&har); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: "HAR 文件格式错误：" + err.Error()})
+		return
+	}
+	h.writeJson(w, ResponseData{
+		Code: 1,
+		Data: map[string]interface{}{
+			"entries":   len(har.Log.Entries),
+			"resources": proxyOnce.ImportHar(har),
+		},
+	})
+}
+
+func (h *HttpServer) harClear(w http.ResponseWriter, r *http.Request) {
+	recorderOnce.Clear()
+	h.writeJson(w, ResponseData{Code: 1})
+}
+
 func (h *HttpServer) setType(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Type string `json:"type"`
@@ -293,19 +367,295 @@ func (h *HttpServer) delete(w http.ResponseWriter, r *http.Request) {
 	h.writeJson(w, ResponseData{Code: 1})
 }
 
+func (h *HttpServer) resources(w http.ResponseWriter, r *http.Request) {
+	var query LibraryQuery
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+			h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+			return
+		}
+	}
+	list, total := libraryOnce.Query(query)
+	h.writeJson(w, ResponseData{
+		Code: 1,
+		Data: map[string]interface{}{
+			"list":  list,
+			"total": total,
+		},
+	})
+}
+
+func (h *HttpServer) resourcesDelete(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Ids []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	ids := make(map[string]bool, len(data.Ids))
+	for _, id := range data.Ids {
+		ids[id] = true
+	}
+	// the sign is released too, so the resource is listed again when it is requested once more
+	for _, record := range libraryOnce.All() {
+		if ids[record.Id] {
+			resourceOnce.delete(record.UrlSign)
+		}
+	}
+	h.writeJson(w, ResponseData{Code: 1})
+}
+
+func (h *HttpServer) history(w http.ResponseWriter, r *http.Request) {
+	h.writeJson(w, ResponseData{
+		Code: 1,
+		Data: historyOnce.List(),
+	})
+}
+
+func (h *HttpServer) historyClear(w http.ResponseWriter, r *http.Request) {
+	if err := historyOnce.Clear(); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	h.writeJson(w, ResponseData{Code: 1})
+}
+
 func (h *HttpServer) download(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		MediaInfo
-		DecodeStr string `json:"decodeStr"`
+		DownloadOptions
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	resourceOnce.download(data.MediaInfo, data.DownloadOptions)
+	h.writeJson(w, ResponseData{Code: 1})
+}
+
+func (h *HttpServer) downloadPause(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Id string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	if !resourceOnce.pause(data.Id) {
+		h.writeJson(w, ResponseData{Code: 0, Message: "任务未在下载中"})
+		return
+	}
+	h.writeJson(w, ResponseData{Code: 1})
+}
+
+func (h *HttpServer) downloadStop(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Id string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	if !resourceOnce.stop(data.Id) {
+		h.writeJson(w, ResponseData{Code: 0, Message: "任务未在录制中"})
+		return
+	}
+	h.writeJson(w, ResponseData{Code: 1})
+}
+
+func (h *HttpServer) downloadResume(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Id string `json:"id"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
 		return
 	}
-	resourceOnce.download(data.MediaInfo, data.DecodeStr)
+	if globalConfig.SaveDirectory == "" {
+		h.writeJson(w, ResponseData{Code: 0, Message: "请设置保存位置"})
+		return
+	}
+	if !resourceOnce.resume(data.Id) {
+		h.writeJson(w, ResponseData{Code: 0, Message: "没有可继续的任务"})
+		return
+	}
 	h.writeJson(w, ResponseData{Code: 1})
 }
 
+func (h *HttpServer) downloadSpeed(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Id         string `json:"id"`
+		SpeedLimit int    `json:"speedLimit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	if !resourceOnce.setSpeedLimit(data.Id, data.SpeedLimit) {
+		h.writeJson(w, ResponseData{Code: 0, Message: "任务不存在"})
+		return
+	}
+	h.writeJson(w, ResponseData{Code: 1})
+}
+
+func (h *HttpServer) downloadCancel(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Id         string `json:"id"`
+		DeleteFile bool   `json:"deleteFile"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	if !resourceOnce.cancel(data.Id, data.DeleteFile) {
+		h.writeJson(w, ResponseData{Code: 0, Message: "任务不存在"})
+		return
+	}
+	h.writeJson(w, ResponseData{Code: 1})
+}
+
+func (h *HttpServer) queue(w http.ResponseWriter, r *http.Request) {
+	h.writeJson(w, ResponseData{
+		Code: 1,
+		Data: map[string]interface{}{
+			"items":        queueOnce.list(),
+			"running":      queueOnce.runningCount(),
+			"maxDownloads": queueOnce.maxRunning(),
+		},
+	})
+}
+
+func (h *HttpServer) queueMove(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Id    string `json:"id"`
+		Index int    `json:"index"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	if !queueOnce.move(data.Id, data.Index) {
+		h.writeJson(w, ResponseData{Code: 0, Message: "任务不在队列中"})
+		return
+	}
+	h.writeJson(w, ResponseData{Code: 1, Data: queueOnce.list()})
+}
+
+func (h *HttpServer) queueTop(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Id string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	if !queueOnce.move(data.Id, 0) {
+		h.writeJson(w, ResponseData{Code: 0, Message: "任务不在队列中"})
+		return
+	}
+	h.writeJson(w, ResponseData{Code: 1, Data: queueOnce.list()})
+}
+
+func (h *HttpServer) downloadJournals(w http.ResponseWriter, r *http.Request) {
+	h.writeJson(w, ResponseData{
+		Code: 1,
+		Data: resourceOnce.listJournals(),
+	})
+}
+
+func (h *HttpServer) remux(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Filename string `json:"filename"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	if !FileExist(data.Filename) {
+		h.writeJson(w, ResponseData{Code: 0, Message: "文件不存在"})
+		return
+	}
+	savePath := RemuxPath(data.Filename)
+	if err := RemuxFile(data.Filename, savePath); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	h.writeJson(w, ResponseData{
+		Code: 1,
+		Data: map[string]string{
+			"save_path": savePath,
+		},
+	})
+}
+
+func (h *HttpServer) dashRepresentations(w http.ResponseWriter, r *http.Request) {
+	var data MediaInfo
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	downloader := NewDashDownloader(data.Url, "")
+	downloader.Headers = resourceOnce.capturedHeaders(data)
+	downloader.CapturedUrl = data.Url
+	manifest, err := downloader.LoadManifest()
+	if err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	h.writeJson(w, ResponseData{
+		Code: 1,
+		Data: map[string]interface{}{
+			"representations": manifest.Representations,
+			"duration":        manifest.Duration,
+			"dynamic":         manifest.Dynamic,
+		},
+	})
+}
+
+func (h *HttpServer) filenamePreview(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		MediaInfo
+		Template string `json:"template"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	template := data.Template
+	if template == "" {
+		template = filenameTemplate()
+	}
+	h.writeJson(w, ResponseData{
+		Code: 1,
+		Data: map[string]interface{}{
+			"path": filepath.FromSlash(RenderFilename(template, data.MediaInfo, time.Now())),
+		},
+	})
+}
+
+func (h *HttpServer) hlsVariants(w http.ResponseWriter, r *http.Request) {
+	var data MediaInfo
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	downloader := NewHlsDownloader(data.Url, "")
+	downloader.Headers = resourceOnce.capturedHeaders(data)
+	downloader.CapturedUrl = data.Url
+	variants, err := downloader.Variants()
+	if err != nil {
+		h.writeJson(w, ResponseData{Code: 0, Message: err.Error()})
+		return
+	}
+	h.writeJson(w, ResponseData{
+		Code: 1,
+		Data: map[string]interface{}{
+			"variants": variants,
+		},
+	})
+}
+
 func (h *HttpServer) wxFileDecode(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		MediaInfo
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// JournalSuffix is appended to the target file name to build the sidecar journal path
+const JournalSuffix = ".rdl"
+
+type JournalTask struct {
+	TaskID         int   `json:"TaskID"`
+	RangeStart     int64 `json:"RangeStart"`
+	RangeEnd       int64 `json:"RangeEnd"`
+	DownloadedSize int64 `json:"DownloadedSize"`
+	IsCompleted    bool  `json:"IsCompleted"`
+}
+
+type DownloadJournal struct {
+	Url          string        `json:"Url"`
+	FileName     string        `json:"FileName"`
+	ETag         string        `json:"ETag"`
+	LastModified string        `json:"LastModified"`
+	TotalSize    int64         `json:"TotalSize"`
+	IsMultiPart  bool          `json:"IsMultiPart"`
+	MediaInfo    MediaInfo     `json:"MediaInfo"`
+	DecodeStr    string        `json:"DecodeStr"`
+	Tasks        []JournalTask `json:"Tasks"`
+	UpdatedAt    int64         `json:"UpdatedAt"`
+	lastSave     time.Time
+}
+
+func journalPath(fileName string) string {
+	return fileName + JournalSuffix
+}
+
+func LoadJournal(fileName string) (*DownloadJournal, error) {
+	data, err := os.ReadFile(journalPath(fileName))
+	if err != nil {
+		return nil, err
+	}
+	journal := &DownloadJournal{}
+	if err := json.Unmarshal(data, journal); err != nil {
+		return nil, err
+	}
+	return journal, nil
+}
+
+// ListJournals walks dir and returns every journal whose download has not finished
+func ListJournals(dir string) []*DownloadJournal {
+	journals := make([]*DownloadJournal, 0)
+	if dir == "" {
+		return journals
+	}
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, JournalSuffix) {
+			return nil
+		}
+		journal, err := LoadJournal(strings.TrimSuffix(path, JournalSuffix))
+		if err != nil {
+			globalLogger.Esg(err, "load journal %s", path)
+			return nil
+		}
+		if !journal.IsComplete() {
+			journals = append(journals, journal)
+		}
+		return nil
+	})
+	return journals
+}
+
+func (j *DownloadJournal) Save() error {
+	j.UpdatedAt = time.Now().Unix()
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	path := journalPath(j.FileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	j.lastSave = time.Now()
+	return os.Rename(tmp, path)
+}
+
+func (j *DownloadJournal) Remove() {
+	_ = os.Remove(journalPath(j.FileName))
+}
+
+// Matches reports whether the remote file described by the response headers is still the one the journal was written for
+func (j *DownloadJournal) Matches(etag, lastModified string, totalSize int64) bool {
+	if j.TotalSize != totalSize {
+		return false
+	}
+	if j.ETag != "" && etag != "" && j.ETag != etag {
+		return false
+	}
+	if j.LastModified != "" && lastModified != "" && j.LastModified != lastModified {
+		return false
+	}
+	return true
+}
+
+func (j *DownloadJournal) IsComplete() bool {
+	if len(j.Tasks) == 0 {
+		return false
+	}
+	for _, task := range j.Tasks {
+		if !task.IsCompleted {
+			return false
+		}
+	}
+	return true
+}
+
+func (j *DownloadJournal) DownloadedSize() int64 {
+	var size int64
+	for _, task := range j.Tasks {
+		size += task.DownloadedSize
+	}
+	return size
+}
@@ -0,0 +1,215 @@
+package core
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/elazarl/goproxy"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// leafCacheSize bounds how many signed host certificates are kept
+	leafCacheSize = 1024
+	// leafValidity stays below the 398 days browsers accept for server certificates
+	leafValidity = 397 * 24 * time.Hour
+	// leafRenewBefore drops a cached certificate this long before it expires
+	leafRenewBefore = 24 * time.Hour
+)
+
+// TLSStats counts how the leaf certificate cache performed
+type TLSStats struct {
+	Hits      int64 `json:"Hits"`
+	Misses    int64 `json:"Misses"`
+	Evictions int64 `json:"Evictions"`
+	Errors    int64 `json:"Errors"`
+	Size      int   `json:"Size"`
+	Capacity  int   `json:"Capacity"`
+}
+
+type leafEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+// leafCall is a signing in progress, connections to the same host wait for it instead of signing again
+type leafCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// leafCache signs host certificates with the root CA and keeps the recently used ones,
+// the connections share session ticket keys so a client can resume its TLS session
+type leafCache struct {
+	ca       tls.Certificate
+	capacity int
+	mu       sync.Mutex
+	order    *list.List
+	entries  map[string]*list.Element
+	calls    map[string]*leafCall
+	config   *tls.Config
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+	errors    atomic.Int64
+}
+
+func newLeafCache(ca tls.Certificate, capacity int) *leafCache {
+	c := &leafCache{
+		ca:       ca,
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		calls:    make(map[string]*leafCall),
+	}
+	c.config = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// goproxy reads intercepted connections as HTTP/1.1
+		NextProtos: []string{"http/1.1"},
+	}
+	// every connection gets a clone of the config, fixed ticket keys let a session be resumed on the next one
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err == nil {
+		c.config.SetSessionTicketKeys([][32]byte{key})
+	}
+	return c
+}
+
+// tlsConfig is the goproxy hook for intercepted CONNECTs, the certificate is picked by SNI during the handshake
+// and the CONNECT host is used when the client sends none
+func (c *leafCache) tlsConfig(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	connectHost := stripPort(host)
+	config := c.config.Clone()
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+		if name == "" {
+			name = connectHost
+		}
+		return c.get(name)
+	}
+	return config, nil
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return strings.ToLower(h)
+	}
+	return strings.ToLower(host)
+}
+
+// get returns the certificate for host, signing it on a miss
+func (c *leafCache) get(host string) (*tls.Certificate, error) {
+	c.mu.Lock()
+	if element, ok := c.entries[host]; ok {
+		entry := element.Value.(*leafEntry)
+		if time.Until(entry.cert.Leaf.NotAfter) > leafRenewBefore {
+			c.order.MoveToFront(element)
+			c.mu.Unlock()
+			c.hits.Add(1)
+			return entry.cert, nil
+		}
+		c.order.Remove(element)
+		delete(c.entries, host)
+	}
+	if call, ok := c.calls[host]; ok {
+		c.mu.Unlock()
+		<-call.done
+		c.hits.Add(1)
+		return call.cert, call.err
+	}
+	call := &leafCall{done: make(chan struct{})}
+	c.calls[host] = call
+	c.mu.Unlock()
+
+	c.misses.Add(1)
+	call.cert, call.err = signLeaf(c.ca, host)
+	if call.err != nil {
+		c.errors.Add(1)
+	}
+
+	c.mu.Lock()
+	delete(c.calls, host)
+	if call.err == nil {
+		c.entries[host] = c.order.PushFront(&leafEntry{host: host, cert: call.cert})
+		for c.order.Len() > c.capacity {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*leafEntry).host)
+			c.evictions.Add(1)
+		}
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.cert, call.err
+}
+
+func (c *leafCache) stats() TLSStats {
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+	return TLSStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Errors:    c.errors.Load(),
+		Size:      size,
+		Capacity:  c.capacity,
+	}
+}
+
+// signLeaf issues a certificate for host with a P-256 key, much cheaper to create and use than RSA
+func signLeaf(ca tls.Certificate, host string) (*tls.Certificate, error) {
+	if ca.Leaf == nil {
+		return nil, errors.New("CA certificate is not parsed")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-24 * time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if template.NotAfter.After(ca.Leaf.NotAfter) {
+		template.NotAfter = ca.Leaf.NotAfter
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Certificate[0]},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
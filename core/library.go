@@ -0,0 +1,299 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LibraryRecord is a captured resource as kept across restarts
+type LibraryRecord struct {
+	MediaInfo
+	CreatedAt    int64 `json:"CreatedAt"`
+	UpdatedAt    int64 `json:"UpdatedAt"`
+	DownloadedAt int64 `json:"DownloadedAt"`
+}
+
+// libraryLine is one entry of the append-only log, a put carries the whole record
+type libraryLine struct {
+	Op     string         `json:"op"`
+	Record *LibraryRecord `json:"record,omitempty"`
+	Id     string         `json:"id,omitempty"`
+}
+
+// LibraryQuery filters the library, empty fields match everything
+type LibraryQuery struct {
+	Classify string `json:"classify"`
+	Status   string `json:"status"`
+	Domain   string `json:"domain"`
+	Keyword  string `json:"keyword"`
+	Offset   int    `json:"offset"`
+	Limit    int    `json:"limit"`
+}
+
+// Library stores every captured resource as JSON lines in the user directory, the log is compacted on load
+type Library struct {
+	fileName string
+	mu       sync.Mutex
+	records  map[string]*LibraryRecord
+	file     *os.File
+	lines    int
+}
+
+func initLibrary() *Library {
+	if libraryOnce == nil {
+		libraryOnce = &Library{
+			fileName: filepath.Join(appOnce.UserDir, "library.jsonl"),
+			records:  make(map[string]*LibraryRecord),
+		}
+		if err := libraryOnce.load(); err != nil {
+			globalLogger.Esg(err, "load library err")
+		}
+	}
+	return libraryOnce
+}
+
+func (l *Library) load() error {
+	if err := os.MkdirAll(filepath.Dir(l.fileName), os.ModePerm); err != nil {
+		return err
+	}
+	if file, err := os.Open(l.fileName); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16<<20)
+		for scanner.Scan() {
+			var line libraryLine
+			// a line cut short by a crash is skipped
+			if json.Unmarshal(scanner.Bytes(), &line) != nil {
+				continue
+			}
+			l.apply(line)
+			l.lines++
+		}
+		file.Close()
+	}
+	// downloads cut off by the last exit are no longer running, unfinished files are listed again from their journals
+	for _, record := range l.records {
+		switch record.Status {
+		case DownloadStatusRunning, DownloadStatusQueued, DownloadStatusPaused, DownloadStatusHandle:
+			record.Status = DownloadStatusReady
+			l.lines++
+		}
+	}
+	if l.lines > len(l.records) {
+		if err := l.compact(); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(l.fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	return nil
+}
+
+func (l *Library) apply(line libraryLine) {
+	switch line.Op {
+	case "put":
+		if line.Record != nil {
+			l.records[line.Record.Id] = line.Record
+		}
+	case "delete":
+		delete(l.records, line.Id)
+	case "clear":
+		l.records = make(map[string]*LibraryRecord)
+	}
+}
+
+// compact rewrites the log with one put per record
+func (l *Library) compact() error {
+	tmp := l.fileName + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, record := range l.sorted() {
+		data, err := json.Marshal(libraryLine{Op: "put", Record: record})
+		if err != nil {
+			continue
+		}
+		_, _ = writer.Write(append(data, '\n'))
+	}
+	if err = writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	l.lines = len(l.records)
+	return os.Rename(tmp, l.fileName)
+}
+
+func (l *Library) write(line libraryLine) {
+	l.apply(line)
+	if l.file == nil {
+		return
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	if _, err = l.file.Write(append(data, '\n')); err != nil {
+		globalLogger.Esg(err, "write library err")
+	}
+	// segment counts and progress rewrite records often, the log is kept within a few times the live records
+	if l.lines++; l.lines > 4*len(l.records)+1000 {
+		l.file.Close()
+		if err = l.compact(); err != nil {
+			globalLogger.Esg(err, "compact library err")
+		}
+		if l.file, err = os.OpenFile(l.fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			globalLogger.Esg(err, "open library err")
+			l.file = nil
+		}
+	}
+}
+
+// sorted returns the records in capture order
+func (l *Library) sorted() []*LibraryRecord {
+	records := make([]*LibraryRecord, 0, len(l.records))
+	for _, record := range l.records {
+		records = append(records, record)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].CreatedAt != records[j].CreatedAt {
+			return records[i].CreatedAt < records[j].CreatedAt
+		}
+		return records[i].Id < records[j].Id
+	})
+	return records
+}
+
+// Add records a newly captured resource
+func (l *Library) Add(mediaInfo MediaInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now().Unix()
+	// a resource captured again after the list was cleared replaces its earlier record
+	for id, record := range l.records {
+		if record.UrlSign == mediaInfo.UrlSign && id != mediaInfo.Id {
+			l.write(libraryLine{Op: "delete", Id: id})
+		}
+	}
+	l.write(libraryLine{Op: "put", Record: &LibraryRecord{MediaInfo: mediaInfo, CreatedAt: now, UpdatedAt: now}})
+}
+
+// update changes a record in place and logs it, unknown ids are ignored
+func (l *Library) update(id string, change func(record *LibraryRecord) bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record, ok := l.records[id]
+	if !ok {
+		return
+	}
+	updated := *record
+	if !change(&updated) {
+		return
+	}
+	updated.UpdatedAt = time.Now().Unix()
+	l.write(libraryLine{Op: "put", Record: &updated})
+}
+
+// SetStatus stores the outcome of a download
+func (l *Library) SetStatus(id, status, savePath, hash string) {
+	l.update(id, func(record *LibraryRecord) bool {
+		if record.Status == status && (savePath == "" || record.SavePath == savePath) && (hash == "" || record.Hash == hash) {
+			return false
+		}
+		record.Status = status
+		if savePath != "" {
+			record.SavePath = savePath
+		}
+		if hash != "" {
+			record.Hash = hash
+		}
+		if status == DownloadStatusDone {
+			record.DownloadedAt = time.Now().Unix()
+		}
+		return true
+	})
+}
+
+// SetSegments stores how many requests were folded into the resources with the given sign
+func (l *Library) SetSegments(urlSign string, segments int) {
+	for _, id := range l.idsBySign(urlSign) {
+		l.update(id, func(record *LibraryRecord) bool {
+			record.Segments = segments
+			return true
+		})
+	}
+}
+
+func (l *Library) idsBySign(urlSign string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ids []string
+	for id, record := range l.records {
+		if record.UrlSign == urlSign {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (l *Library) Delete(ids ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range ids {
+		if _, ok := l.records[id]; ok {
+			l.write(libraryLine{Op: "delete", Id: id})
+		}
+	}
+}
+
+func (l *Library) DeleteBySign(urlSign string) {
+	l.Delete(l.idsBySign(urlSign)...)
+}
+
+// Query returns the matching records in capture order and how many matched before paging
+func (l *Library) Query(query LibraryQuery) ([]*LibraryRecord, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keyword := strings.ToLower(query.Keyword)
+	matched := make([]*LibraryRecord, 0)
+	for _, record := range l.sorted() {
+		if query.Classify != "" && record.Classify != query.Classify ||
+			query.Status != "" && record.Status != query.Status ||
+			query.Domain != "" && record.Domain != query.Domain {
+			continue
+		}
+		if keyword != "" && !strings.Contains(strings.ToLower(record.Url), keyword) &&
+			!strings.Contains(strings.ToLower(record.Description), keyword) &&
+			!strings.Contains(strings.ToLower(record.SavePath), keyword) {
+			continue
+		}
+		matched = append(matched, record)
+	}
+	total := len(matched)
+	if query.Offset > 0 {
+		matched = matched[min(query.Offset, total):]
+	}
+	if query.Limit > 0 && len(matched) > query.Limit {
+		matched = matched[:query.Limit]
+	}
+	return matched, total
+}
+
+// All returns every record in capture order
+func (l *Library) All() []*LibraryRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sorted()
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket measured in bytes per second, a rate of 0 means unlimited
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{
+		rate: rate,
+		last: time.Now(),
+	}
+}
+
+func initLimiter() *RateLimiter {
+	if globalLimiter == nil {
+		globalLimiter = NewRateLimiter(int64(globalConfig.SpeedLimit) * 1024)
+	}
+	return globalLimiter
+}
+
+// SetRate changes the rate on the fly, readers already waiting pick it up on their next check
+func (l *RateLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// WaitN blocks until n bytes may be consumed or ctx is done
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	for {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		now := time.Now()
+		burst := float64(max(l.rate, int64(n)))
+		l.tokens = min(burst, l.tokens+now.Sub(l.last).Seconds()*float64(l.rate))
+		l.last = now
+		if l.tokens >= float64(n) {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((float64(n) - l.tokens) / float64(l.rate) * float64(time.Second))
+		l.mu.Unlock()
+
+		// wake up regularly so a changed rate takes effect quickly
+		wait = min(wait, 200*time.Millisecond)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
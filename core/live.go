@@ -0,0 +1,452 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// errRecordStopped ends a recording on purpose, what was recorded so far is kept
+var errRecordStopped = errors.New("recording stopped")
+
+const flvTagScript = 18
+
+// LiveRecorder records an open ended HTTP-FLV stream or a sliding window HLS playlist until it ends, is stopped or reaches a limit
+type LiveRecorder struct {
+	Url              string
+	FileName         string
+	Variant          string
+	Headers          map[string]string
+	CapturedUrl      string
+	Limiter          *RateLimiter
+	MaxDuration      time.Duration
+	MaxSize          int64
+	SplitDuration    time.Duration
+	Files            []string
+	Duration         time.Duration
+	Size             int64
+	progressCallback ProgressCallback
+	reservePath      func(path string) string
+	ctx              context.Context
+	hls              *HlsDownloader
+	file             *os.File
+	fileStart        time.Duration
+	maps             map[string][]byte
+	speed            float64
+	lastTime         time.Time
+	lastSize         int64
+}
+
+func NewLiveRecorder(url, filename string) *LiveRecorder {
+	return &LiveRecorder{
+		Url:      url,
+		FileName: filename,
+		maps:     make(map[string][]byte),
+		ctx:      context.Background(),
+		// FileName is reserved by the caller, the names derived from it are claimed as they are needed
+		reservePath: availablePath,
+	}
+}
+
+func (lr *LiveRecorder) limitReached() bool {
+	return (lr.MaxDuration > 0 && lr.Duration >= lr.MaxDuration) || (lr.MaxSize > 0 && lr.Size >= lr.MaxSize)
+}
+
+func (lr *LiveRecorder) splitDue() bool {
+	return lr.SplitDuration > 0 && lr.Duration-lr.fileStart >= lr.SplitDuration
+}
+
+// nextFile closes the current file and starts the next one, split files are numbered
+func (lr *LiveRecorder) nextFile(ext string) error {
+	lr.closeFile()
+	base := strings.TrimSuffix(lr.FileName, filepath.Ext(lr.FileName))
+	fileName := base + ext
+	if lr.SplitDuration > 0 {
+		fileName = fmt.Sprintf("%s_%03d%s", base, len(lr.Files)+1, ext)
+	}
+	if fileName != lr.FileName {
+		fileName = lr.reservePath(fileName)
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	lr.file = file
+	lr.fileStart = lr.Duration
+	lr.Files = append(lr.Files, fileName)
+	return nil
+}
+
+func (lr *LiveRecorder) closeFile() {
+	if lr.file != nil {
+		_ = lr.file.Close()
+		lr.file = nil
+	}
+}
+
+func (lr *LiveRecorder) write(data ...[]byte) error {
+	for _, item := range data {
+		if _, err := lr.file.Write(item); err != nil {
+			return err
+		}
+		lr.Size += int64(len(item))
+	}
+	lr.emitProgress(false)
+	return nil
+}
+
+// emitProgress reports the recorded duration and size, a live stream has no total
+func (lr *LiveRecorder) emitProgress(force bool) {
+	if lr.progressCallback == nil {
+		return
+	}
+	now := time.Now()
+	elapsed := now.Sub(lr.lastTime)
+	if elapsed < progressInterval && !force {
+		return
+	}
+	if !lr.lastTime.IsZero() && elapsed > 0 {
+		instant := float64(lr.Size-lr.lastSize) / elapsed.Seconds()
+		if lr.speed == 0 {
+			lr.speed = instant
+		} else {
+			lr.speed = 0.3*instant + 0.7*lr.speed
+		}
+	}
+	lr.lastTime = now
+	lr.lastSize = lr.Size
+	lr.progressCallback(DownloadProgress{
+		Downloaded: lr.Size,
+		Speed:      int64(lr.speed),
+		Eta:        -1,
+		Duration:   lr.Duration.Seconds(),
+	})
+}
+
+// stallReader cancels the recording when the stream delivers nothing within the stall timeout
+type stallReader struct {
+	reader   io.Reader
+	ctx      context.Context
+	limiter  *RateLimiter
+	watchdog *time.Timer
+	timeout  time.Duration
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	if n > 0 {
+		s.watchdog.Reset(s.timeout)
+		if werr := waitLimit(s.ctx, s.limiter, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (lr *LiveRecorder) Start() error {
+	ctx, cancel := context.WithCancelCause(lr.ctx)
+	defer cancel(nil)
+	lr.hls = NewHlsDownloader(lr.Url, "")
+	lr.hls.ctx = ctx
+	lr.hls.Headers = lr.Headers
+	lr.hls.CapturedUrl = lr.CapturedUrl
+	lr.hls.Limiter = lr.Limiter
+	lr.hls.prepare()
+
+	err := lr.record(ctx, cancel)
+	lr.closeFile()
+	lr.emitProgress(true)
+	if cause := context.Cause(ctx); cause != nil && cause != context.Canceled {
+		err = cause
+	}
+	switch {
+	case err == nil, err == errRecordStopped, err == errDownloadPaused:
+		return nil
+	case err == errDownloadCancelled:
+		return err
+	case lr.Size > 0:
+		// a live stream usually ends with a broken connection, keep what was recorded
+		globalLogger.Warn().Msgf("recording %s ended: %v", lr.Url, err)
+		return nil
+	}
+	return err
+}
+
+func (lr *LiveRecorder) record(ctx context.Context, cancel context.CancelCauseFunc) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, lr.Url, nil)
+	if err != nil {
+		return err
+	}
+	lr.hls.setHeaders(request)
+	resp, err := lr.hls.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("服务器返回非200状态码: %d", resp.StatusCode)
+	}
+
+	timeout := time.Duration(globalConfig.StallTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	watchdog := time.AfterFunc(timeout, func() {
+		cancel(errDownloadStalled)
+	})
+	defer watchdog.Stop()
+	reader := bufio.NewReader(&stallReader{
+		reader:   resp.Body,
+		ctx:      ctx,
+		limiter:  lr.Limiter,
+		watchdog: watchdog,
+		timeout:  timeout,
+	})
+
+	header, _ := reader.Peek(9)
+	switch {
+	case strings.Contains(strings.ToLower(resp.Header.Get("Content-Type")), "mpegurl") || strings.HasPrefix(string(header), "#EXTM3U"):
+		content, err := io.ReadAll(io.LimitReader(reader, 4*1024*1024))
+		if err != nil {
+			return err
+		}
+		watchdog.Stop()
+		playlist, err := ParseM3u8(string(content), lr.Url)
+		if err != nil {
+			return err
+		}
+		return lr.recordHls(ctx, playlist)
+	case strings.HasPrefix(string(header), "FLV"):
+		return lr.recordFlv(reader)
+	default:
+		return lr.recordRaw(reader, header)
+	}
+}
+
+// recordFlv copies FLV tags, every split file starts at a key frame with the stream's metadata and codec configuration
+func (lr *LiveRecorder) recordFlv(reader io.Reader) error {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	dataOffset := int64(binary.BigEndian.Uint32(header[5:9]))
+	if _, err := io.CopyN(io.Discard, reader, dataOffset-9+4); err != nil {
+		return err
+	}
+	fileHeader := append(append([]byte{}, header[:5]...), 0, 0, 0, 9, 0, 0, 0, 0)
+
+	var metadata, videoConfig, audioConfig []byte
+	firstTimestamp, fileTimestamp := int64(-1), int64(0)
+	hasVideo := false
+	tagHeader := make([]byte, 11)
+	for {
+		if _, err := io.ReadFull(reader, tagHeader); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := int(tagHeader[1])<<16 | int(tagHeader[2])<<8 | int(tagHeader[3])
+		tag := make([]byte, 11+size)
+		copy(tag, tagHeader)
+		if _, err := io.ReadFull(reader, tag[11:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, reader, 4); err != nil {
+			return err
+		}
+		data := tag[11:]
+		timestamp := int64(tagHeader[7])<<24 | int64(tagHeader[4])<<16 | int64(tagHeader[5])<<8 | int64(tagHeader[6])
+		isConfig, isKey := false, false
+		switch tagHeader[0] & 0x1F {
+		case flvTagScript:
+			metadata, isConfig = tag, true
+		case flvTagVideo:
+			hasVideo = true
+			if len(data) >= 2 && data[0]&0x0F == 7 && data[1] == 0 {
+				videoConfig, isConfig = tag, true
+			} else {
+				isKey = len(data) > 0 && data[0]>>4 == 1
+			}
+		case flvTagAudio:
+			if len(data) >= 2 && data[0]>>4 == 10 && data[1] == 0 {
+				audioConfig, isConfig = tag, true
+			}
+		}
+
+		// configuration tags are often stamped 0 ahead of the first frame, they do not count towards the duration
+		if !isConfig {
+			if firstTimestamp < 0 {
+				firstTimestamp = timestamp
+			}
+			if timestamp > firstTimestamp {
+				lr.Duration = time.Duration(timestamp-firstTimestamp) * time.Millisecond
+			}
+		}
+
+		if lr.file == nil || (!isConfig && lr.splitDue() && (isKey || !hasVideo)) {
+			if err := lr.nextFile(".flv"); err != nil {
+				return err
+			}
+			if err := lr.write(fileHeader); err != nil {
+				return err
+			}
+			for _, config := range [][]byte{metadata, videoConfig, audioConfig} {
+				if config != nil && !isConfig {
+					if err := lr.writeFlvTag(config, 0); err != nil {
+						return err
+					}
+				}
+			}
+			fileTimestamp = timestamp
+		}
+		if err := lr.writeFlvTag(tag, max(0, timestamp-fileTimestamp)); err != nil {
+			return err
+		}
+		if lr.limitReached() {
+			return nil
+		}
+	}
+}
+
+func (lr *LiveRecorder) writeFlvTag(tag []byte, timestamp int64) error {
+	header := append([]byte{}, tag[:11]...)
+	header[4], header[5], header[6], header[7] = byte(timestamp>>16), byte(timestamp>>8), byte(timestamp), byte(timestamp>>24)
+	return lr.write(header, tag[11:], be32(uint32(len(tag))))
+}
+
+// recordHls polls a live playlist and appends every new segment, it ends when the playlist gets an end tag
+func (lr *LiveRecorder) recordHls(ctx context.Context, playlist *M3u8Playlist) error {
+	playlistUrl := lr.Url
+	if playlist.IsMaster {
+		if len(playlist.Variants) == 0 {
+			return fmt.Errorf("m3u8 未包含可下载的码流")
+		}
+		playlistUrl = selectVariant(playlist.Variants, lr.Variant).Url
+		var err error
+		if playlist, err = lr.hls.fetchPlaylist(playlistUrl); err != nil {
+			return err
+		}
+	}
+
+	lastSequence := int64(-1)
+	mapWritten := ""
+	for {
+		for _, segment := range playlist.Segments {
+			if segment.Sequence <= lastSequence {
+				continue
+			}
+			lastSequence = segment.Sequence
+			data, err := lr.hls.fetchRetry(segment.Url, segment.ByteRange)
+			if err == nil && segment.Key != nil {
+				data, err = lr.hls.decrypt(segment, data)
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return context.Cause(ctx)
+				}
+				// the segment may already have left the window, carry on with the next one
+				globalLogger.Warn().Msgf("live segment %d skipped: %v", segment.Sequence, err)
+				continue
+			}
+
+			if lr.file == nil || lr.splitDue() {
+				ext := ".ts"
+				if segment.Map != nil {
+					ext = ".mp4"
+				}
+				if err = lr.nextFile(ext); err != nil {
+					return err
+				}
+				mapWritten = ""
+			}
+			if segment.Map != nil && segment.Map.Url != mapWritten {
+				initData, err := lr.initSection(segment.Map)
+				if err != nil {
+					return err
+				}
+				if err = lr.write(initData); err != nil {
+					return err
+				}
+				mapWritten = segment.Map.Url
+			}
+			lr.Duration += time.Duration(segment.Duration * float64(time.Second))
+			if err = lr.write(data); err != nil {
+				return err
+			}
+			if lr.limitReached() {
+				return nil
+			}
+		}
+		if playlist.EndList {
+			return nil
+		}
+
+		interval := time.Duration(playlist.TargetDuration * float64(time.Second) / 2)
+		interval = max(time.Second, interval)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+		next, err := lr.hls.fetchPlaylist(playlistUrl)
+		if err != nil {
+			return err
+		}
+		playlist = next
+	}
+}
+
+func (lr *LiveRecorder) initSection(initMap *M3u8Map) ([]byte, error) {
+	if data, ok := lr.maps[initMap.Url]; ok {
+		return data, nil
+	}
+	data, err := lr.hls.fetchRetry(initMap.Url, initMap.ByteRange)
+	if err != nil {
+		return nil, err
+	}
+	lr.maps[initMap.Url] = data
+	return data, nil
+}
+
+// recordRaw copies a stream of an unknown container, the duration is measured by the clock
+func (lr *LiveRecorder) recordRaw(reader io.Reader, header []byte) error {
+	ext := filepath.Ext(lr.FileName)
+	if remuxFormat(header) == "ts" || (len(header) > 0 && header[0] == 0x47) {
+		ext = ".ts"
+	}
+	if err := lr.nextFile(ext); err != nil {
+		return err
+	}
+	started := time.Now()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			lr.Duration = time.Since(started)
+			if werr := lr.write(buf[:n]); werr != nil {
+				return werr
+			}
+			if lr.limitReached() {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
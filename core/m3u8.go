@@ -0,0 +1,239 @@
+package core
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type M3u8Variant struct {
+	Url        string `json:"Url"`
+	Bandwidth  int64  `json:"Bandwidth"`
+	Resolution string `json:"Resolution"`
+	Codecs     string `json:"Codecs"`
+	Name       string `json:"Name"`
+}
+
+type M3u8Key struct {
+	Method string
+	Url    string
+	Iv     []byte
+}
+
+type M3u8ByteRange struct {
+	Length int64
+	Offset int64
+}
+
+type M3u8Map struct {
+	Url       string
+	ByteRange *M3u8ByteRange
+}
+
+type M3u8Segment struct {
+	Url           string
+	Duration      float64
+	Sequence      int64
+	Key           *M3u8Key
+	Map           *M3u8Map
+	ByteRange     *M3u8ByteRange
+	Discontinuity bool
+}
+
+type M3u8Playlist struct {
+	IsMaster       bool
+	Variants       []M3u8Variant
+	Segments       []*M3u8Segment
+	TargetDuration float64
+	MediaSequence  int64
+	EndList        bool
+}
+
+// ParseM3u8 parses a master or media playlist, relative URIs are resolved against baseUrl
+func ParseM3u8(content, baseUrl string) (*M3u8Playlist, error) {
+	base, err := url.Parse(baseUrl)
+	if err != nil {
+		return nil, err
+	}
+	playlist := &M3u8Playlist{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+
+	var (
+		header        bool
+		streamInf     map[string]string
+		key           *M3u8Key
+		initMap       *M3u8Map
+		duration      float64
+		byteRange     *M3u8ByteRange
+		discontinuity bool
+		lastRangeUrl  string
+		lastRangeEnd  int64
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !header {
+			if !strings.HasPrefix(line, "#EXTM3U") {
+				return nil, fmt.Errorf("not a m3u8 playlist")
+			}
+			header = true
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			name, value, _ := strings.Cut(line, ":")
+			switch name {
+			case "#EXT-X-STREAM-INF":
+				streamInf = parseM3u8Attributes(value)
+			case "#EXT-X-TARGETDURATION":
+				playlist.TargetDuration, _ = strconv.ParseFloat(value, 64)
+			case "#EXT-X-MEDIA-SEQUENCE":
+				playlist.MediaSequence, _ = strconv.ParseInt(value, 10, 64)
+			case "#EXT-X-ENDLIST":
+				playlist.EndList = true
+			case "#EXT-X-DISCONTINUITY":
+				discontinuity = true
+			case "#EXTINF":
+				durationStr, _, _ := strings.Cut(value, ",")
+				duration, _ = strconv.ParseFloat(strings.TrimSpace(durationStr), 64)
+			case "#EXT-X-BYTERANGE":
+				byteRange, err = parseM3u8ByteRange(value)
+				if err != nil {
+					return nil, err
+				}
+			case "#EXT-X-KEY":
+				attributes := parseM3u8Attributes(value)
+				if attributes["METHOD"] == "" || attributes["METHOD"] == "NONE" {
+					key = nil
+					break
+				}
+				key = &M3u8Key{
+					Method: attributes["METHOD"],
+					Url:    resolveUrl(base, attributes["URI"]),
+				}
+				if iv := attributes["IV"]; iv != "" {
+					iv = strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X")
+					if key.Iv, err = hex.DecodeString(iv); err != nil || len(key.Iv) != 16 {
+						return nil, fmt.Errorf("invalid key IV: %s", attributes["IV"])
+					}
+				}
+			case "#EXT-X-MAP":
+				attributes := parseM3u8Attributes(value)
+				initMap = &M3u8Map{Url: resolveUrl(base, attributes["URI"])}
+				if attributes["BYTERANGE"] != "" {
+					if initMap.ByteRange, err = parseM3u8ByteRange(attributes["BYTERANGE"]); err != nil {
+						return nil, err
+					}
+					// a map range without an offset starts at the beginning of the resource
+					if initMap.ByteRange.Offset < 0 {
+						initMap.ByteRange.Offset = 0
+					}
+				}
+			}
+			continue
+		}
+
+		uri := resolveUrl(base, line)
+		if streamInf != nil {
+			bandwidth, _ := strconv.ParseInt(streamInf["BANDWIDTH"], 10, 64)
+			playlist.IsMaster = true
+			playlist.Variants = append(playlist.Variants, M3u8Variant{
+				Url:        uri,
+				Bandwidth:  bandwidth,
+				Resolution: streamInf["RESOLUTION"],
+				Codecs:     streamInf["CODECS"],
+				Name:       streamInf["NAME"],
+			})
+			streamInf = nil
+			continue
+		}
+
+		segment := &M3u8Segment{
+			Url:           uri,
+			Duration:      duration,
+			Sequence:      playlist.MediaSequence + int64(len(playlist.Segments)),
+			Key:           key,
+			Map:           initMap,
+			Discontinuity: discontinuity,
+		}
+		if byteRange != nil {
+			if byteRange.Offset < 0 {
+				// without an offset the range continues where the previous one of the same resource ended
+				byteRange.Offset = 0
+				if lastRangeUrl == uri {
+					byteRange.Offset = lastRangeEnd
+				}
+			}
+			segment.ByteRange = byteRange
+			lastRangeUrl = uri
+			lastRangeEnd = byteRange.Offset + byteRange.Length
+		}
+		playlist.Segments = append(playlist.Segments, segment)
+		duration = 0
+		byteRange = nil
+		discontinuity = false
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !header {
+		return nil, fmt.Errorf("not a m3u8 playlist")
+	}
+	return playlist, nil
+}
+
+// parseM3u8ByteRange parses "length[@offset]", a missing offset is returned as -1
+func parseM3u8ByteRange(value string) (*M3u8ByteRange, error) {
+	lengthStr, offsetStr, hasOffset := strings.Cut(strings.Trim(value, `"`), "@")
+	length, err := strconv.ParseInt(lengthStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid byte range: %s", value)
+	}
+	byteRange := &M3u8ByteRange{Length: length, Offset: -1}
+	if hasOffset {
+		if byteRange.Offset, err = strconv.ParseInt(offsetStr, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid byte range: %s", value)
+		}
+	}
+	return byteRange, nil
+}
+
+// parseM3u8Attributes splits an attribute list, commas inside quoted strings are kept
+func parseM3u8Attributes(value string) map[string]string {
+	attributes := make(map[string]string)
+	for len(value) > 0 {
+		name, rest, ok := strings.Cut(value, "=")
+		if !ok {
+			break
+		}
+		name = strings.TrimSpace(name)
+		var attribute string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				attribute, rest = rest[1:], ""
+			} else {
+				attribute, rest = rest[1:end+1], rest[end+2:]
+			}
+			_, rest, _ = strings.Cut(rest, ",")
+		} else {
+			attribute, rest, _ = strings.Cut(rest, ",")
+		}
+		attributes[strings.ToUpper(name)] = strings.TrimSpace(attribute)
+		value = rest
+	}
+	return attributes
+}
+
+func resolveUrl(base *url.URL, ref string) string {
+	parsed, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(parsed).String()
+}
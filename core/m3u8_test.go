@@ -0,0 +1,50 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestParseM3u8ByteRange(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="600"
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000@600
+media.mp4
+#EXTINF:4,
+#EXT-X-BYTERANGE:2000
+media.mp4
+#EXT-X-MAP:URI="init2.mp4",BYTERANGE="700@100"
+#EXTINF:4,
+#EXT-X-BYTERANGE:500
+other.mp4
+#EXT-X-ENDLIST
+`
+	playlist, err := ParseM3u8(content, "https://example.com/live/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlist.Segments) != 3 {
+		t.Fatalf("got %d segments, want 3", len(playlist.Segments))
+	}
+
+	want := []struct {
+		mapRange M3u8ByteRange
+		segRange M3u8ByteRange
+	}{
+		{M3u8ByteRange{Length: 600, Offset: 0}, M3u8ByteRange{Length: 1000, Offset: 600}},
+		{M3u8ByteRange{Length: 600, Offset: 0}, M3u8ByteRange{Length: 2000, Offset: 1600}},
+		{M3u8ByteRange{Length: 700, Offset: 100}, M3u8ByteRange{Length: 500, Offset: 0}},
+	}
+	for i, segment := range playlist.Segments {
+		if segment.Map == nil || segment.Map.ByteRange == nil {
+			t.Fatalf("segment %d has no map range", i)
+		}
+		if *segment.Map.ByteRange != want[i].mapRange {
+			t.Errorf("segment %d map range = %+v, want %+v", i, *segment.Map.ByteRange, want[i].mapRange)
+		}
+		if segment.ByteRange == nil || *segment.ByteRange != want[i].segRange {
+			t.Errorf("segment %d range = %+v, want %+v", i, segment.ByteRange, want[i].segRange)
+		}
+	}
+}
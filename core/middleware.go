@@ -44,14 +44,64 @@ func HandleApi(w http.ResponseWriter, r *http.Request) bool {
 			httpServerOnce.setConfig(w, r)
 		case "/api/get-config":
 			httpServerOnce.getConfig(w, r)
+		case "/api/ca-regenerate":
+			httpServerOnce.caRegenerate(w, r)
+		case "/api/mitm-check":
+			httpServerOnce.mitmCheck(w, r)
+		case "/api/mitm-hosts":
+			httpServerOnce.mitmHosts(w, r)
+		case "/api/tls-stats":
+			httpServerOnce.tlsStats(w, r)
+		case "/api/site-handlers":
+			httpServerOnce.siteHandlers(w, r)
+		case "/api/har-export":
+			httpServerOnce.harExport(w, r)
+		case "/api/har-import":
+			httpServerOnce.harImport(w, r)
+		case "/api/har-clear":
+			httpServerOnce.harClear(w, r)
 		case "/api/set-type":
 			httpServerOnce.setType(w, r)
 		case "/api/clear":
 			httpServerOnce.clear(w, r)
 		case "/api/delete":
 			httpServerOnce.delete(w, r)
+		case "/api/resources":
+			httpServerOnce.resources(w, r)
+		case "/api/resources-delete":
+			httpServerOnce.resourcesDelete(w, r)
+		case "/api/history":
+			httpServerOnce.history(w, r)
+		case "/api/history-clear":
+			httpServerOnce.historyClear(w, r)
 		case "/api/download":
 			httpServerOnce.download(w, r)
+		case "/api/download-pause":
+			httpServerOnce.downloadPause(w, r)
+		case "/api/download-stop":
+			httpServerOnce.downloadStop(w, r)
+		case "/api/download-resume":
+			httpServerOnce.downloadResume(w, r)
+		case "/api/download-speed":
+			httpServerOnce.downloadSpeed(w, r)
+		case "/api/download-cancel":
+			httpServerOnce.downloadCancel(w, r)
+		case "/api/queue":
+			httpServerOnce.queue(w, r)
+		case "/api/queue-move":
+			httpServerOnce.queueMove(w, r)
+		case "/api/queue-top":
+			httpServerOnce.queueTop(w, r)
+		case "/api/download-journals":
+			httpServerOnce.downloadJournals(w, r)
+		case "/api/filename-preview":
+			httpServerOnce.filenamePreview(w, r)
+		case "/api/hls-variants":
+			httpServerOnce.hlsVariants(w, r)
+		case "/api/dash-representations":
+			httpServerOnce.dashRepresentations(w, r)
+		case "/api/remux":
+			httpServerOnce.remux(w, r)
 		case "/api/wx-file-decode":
 			httpServerOnce.wxFileDecode(w, r)
 		}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+)
+
+type mimeType struct {
+	classify string
+	suffix   string
+}
+
+// mimeTypes maps a MIME type to the resource category and the extension files of that type are saved with
+var mimeTypes = map[string]mimeType{
+	"image/png":                 {"image", ".png"},
+	"image/webp":                {"image", ".webp"},
+	"image/jpeg":                {"image", ".jpg"},
+	"image/jpg":                 {"image", ".jpg"},
+	"image/pjpeg":               {"image", ".jpg"},
+	"image/gif":                 {"image", ".gif"},
+	"image/avif":                {"image", ".avif"},
+	"image/bmp":                 {"image", ".bmp"},
+	"image/tiff":                {"image", ".tiff"},
+	"image/heic":                {"image", ".heic"},
+	"image/heif":                {"image", ".heif"},
+	"image/x-icon":              {"image", ".ico"},
+	"image/vnd.microsoft.icon":  {"image", ".ico"},
+	"image/svg+xml":             {"image", ".svg"},
+	"image/vnd.adobe.photoshop": {"image", ".psd"},
+
+	"audio/mpeg":     {"audio", ".mp3"},
+	"audio/mp3":      {"audio", ".mp3"},
+	"audio/wav":      {"audio", ".wav"},
+	"audio/x-wav":    {"audio", ".wav"},
+	"audio/aiff":     {"audio", ".aiff"},
+	"audio/x-aiff":   {"audio", ".aiff"},
+	"audio/aac":      {"audio", ".aac"},
+	"audio/ogg":      {"audio", ".ogg"},
+	"audio/flac":     {"audio", ".flac"},
+	"audio/x-flac":   {"audio", ".flac"},
+	"audio/midi":     {"audio", ".mid"},
+	"audio/x-midi":   {"audio", ".mid"},
+	"audio/x-ms-wma": {"audio", ".wma"},
+	"audio/opus":     {"audio", ".opus"},
+	"audio/webm":     {"audio", ".weba"},
+	"audio/mp4":      {"audio", ".m4a"},
+	"audio/x-m4a":    {"audio", ".m4a"},
+
+	"video/mp4":         {"video", ".mp4"},
+	"video/webm":        {"video", ".webm"},
+	"video/ogg":         {"video", ".ogv"},
+	"video/x-msvideo":   {"video", ".avi"},
+	"video/mpeg":        {"video", ".mpeg"},
+	"video/quicktime":   {"video", ".mov"},
+	"video/x-ms-wmv":    {"video", ".wmv"},
+	"video/3gpp":        {"video", ".3gp"},
+	"video/mp2t":        {"video", ".ts"},
+	"video/iso.segment": {"video", ".m4s"},
+	"video/x-matroska":  {"video", ".mkv"},
+	"video/x-m4v":       {"video", ".m4v"},
+
+	"audio/video": {"live", ".flv"},
+	"video/x-flv": {"live", ".flv"},
+
+	"application/vnd.apple.mpegurl": {"m3u8", ".m3u8"},
+	"application/x-mpegurl":         {"m3u8", ".m3u8"},
+	"audio/mpegurl":                 {"m3u8", ".m3u8"},
+	"audio/x-mpegurl":               {"m3u8", ".m3u8"},
+	"application/dash+xml":          {"mpd", ".mpd"},
+
+	"application/pdf":               {"pdf", ".pdf"},
+	"application/vnd.ms-powerpoint": {"ppt", ".ppt"},
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": {"ppt", ".pptx"},
+	"application/vnd.ms-excel": {"xls", ".xls"},
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": {"xls", ".xlsx"},
+	"application/msword": {"doc", ".doc"},
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": {"doc", ".docx"},
+}
+
+// suffixAliases are extensions that name a category without being the one its MIME type is saved with
+var suffixAliases = map[string]string{
+	".jpeg": "image",
+	".jfif": "image",
+	".tif":  "image",
+	".midi": "audio",
+	".oga":  "audio",
+	".mpg":  "video",
+	".m2ts": "video",
+	".mts":  "video",
+	".f4v":  "video",
+}
+
+// suffixClassify maps every known extension to its category
+var suffixClassify = func() map[string]string {
+	classify := make(map[string]string, len(mimeTypes)+len(suffixAliases))
+	for _, item := range mimeTypes {
+		classify[item.suffix] = item.classify
+	}
+	for suffix, item := range suffixAliases {
+		classify[suffix] = item
+	}
+	return classify
+}()
+
+// TypeSuffix returns the category and file extension of a MIME type, both are empty for types that are not resources
+func TypeSuffix(mime string) (string, string) {
+	if item, ok := mimeTypes[MediaType(mime)]; ok {
+		return item.classify, item.suffix
+	}
+	return "", ""
+}
+
+// ResourceSuffix picks the extension of a resource, the file name the server suggests and then the url path win
+// over the MIME type when they name a known extension of the same category, e.g. .m4v served as video/mp4
+func ResourceSuffix(classify, suffix, rawUrl, contentDisposition string) string {
+	var candidates []string
+	if _, params, err := mime.ParseMediaType(contentDisposition); err == nil && params["filename"] != "" {
+		candidates = append(candidates, params["filename"])
+	}
+	if u, err := url.Parse(rawUrl); err == nil {
+		candidates = append(candidates, u.Path)
+	}
+	for _, name := range candidates {
+		ext := strings.ToLower(path.Ext(name))
+		if ext != "" && suffixClassify[ext] == classify {
+			return ext
+		}
+	}
+	return suffix
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"github.com/elazarl/goproxy"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What the proxy does with a CONNECT to a host
+const (
+	MitmInspect = "mitm"
+	MitmTunnel  = "tunnel"
+	MitmReject  = "reject"
+)
+
+// maxMitmHosts bounds how many hosts that were not inspected are remembered for the UI
+const maxMitmHosts = 500
+
+// MitmRule applies Action to the hosts matching Host, a glob such as *.example.com or a regular expression between slashes,
+// "*.example.com" also matches example.com itself
+type MitmRule struct {
+	Host   string `json:"Host"`
+	Action string `json:"Action"`
+}
+
+// MitmDecision explains how a host is handled, Source is rule, builtin or default
+type MitmDecision struct {
+	Host     string `json:"Host"`
+	Action   string `json:"Action"`
+	Pattern  string `json:"Pattern"`
+	Source   string `json:"Source"`
+	Count    int    `json:"Count"`
+	LastSeen int64  `json:"LastSeen"`
+}
+
+// pinnedHosts pin their certificates or refuse a user installed root, inspecting them only breaks the app
+var pinnedHosts = []string{
+	"*.push.apple.com",
+	"*.icloud.com",
+	"*.apple-cloudkit.com",
+	"gs.apple.com",
+	"*.itunes.apple.com",
+	"login.microsoftonline.com",
+	"login.live.com",
+	"*.windowsupdate.com",
+	"*.update.microsoft.com",
+	"*.dropbox.com",
+	"*.1password.com",
+	"*.bitwarden.com",
+	"*.alipay.com",
+	"*.95516.com",
+	"*.tenpay.com",
+}
+
+var mitmRegexps sync.Map
+
+// matchHost reports whether host matches a glob or /regexp/ pattern
+func matchHost(pattern, host string) bool {
+	pattern = strings.TrimSpace(pattern)
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		value, ok := mitmRegexps.Load(pattern)
+		if !ok {
+			re, err := regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+			if err != nil {
+				// an invalid pattern is reported once and matches nothing
+				globalLogger.Esg(err, "invalid MITM host pattern %s", pattern)
+			}
+			value, _ = mitmRegexps.LoadOrStore(pattern, re)
+		}
+		re := value.(*regexp.Regexp)
+		return re != nil && re.MatchString(host)
+	}
+	pattern = strings.ToLower(pattern)
+	if ok, _ := path.Match(pattern, host); ok {
+		return true
+	}
+	return strings.HasPrefix(pattern, "*.") && host == pattern[2:]
+}
+
+func mitmAction(action string) string {
+	switch action {
+	case MitmTunnel, MitmReject:
+		return action
+	}
+	return MitmInspect
+}
+
+// EvaluateMitm decides what to do with a host, the configured rules are tried in order before the built-in pinned list
+func EvaluateMitm(host string) MitmDecision {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rule := range globalConfig.MitmRules {
+		if matchHost(rule.Host, host) {
+			return MitmDecision{Host: host, Action: mitmAction(rule.Action), Pattern: rule.Host, Source: "rule"}
+		}
+	}
+	if !globalConfig.MitmInspectPinned {
+		for _, pattern := range pinnedHosts {
+			if matchHost(pattern, host) {
+				return MitmDecision{Host: host, Action: MitmTunnel, Pattern: pattern, Source: "builtin"}
+			}
+		}
+	}
+	return MitmDecision{Host: host, Action: MitmInspect, Source: "default"}
+}
+
+// mitmHosts remembers the hosts that were tunneled or rejected
+type mitmHosts struct {
+	mu    sync.Mutex
+	hosts map[string]*MitmDecision
+}
+
+func (m *mitmHosts) add(decision MitmDecision) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hosts == nil {
+		m.hosts = make(map[string]*MitmDecision)
+	}
+	known, ok := m.hosts[decision.Host]
+	if !ok {
+		if len(m.hosts) >= maxMitmHosts {
+			m.evict()
+		}
+		known = &decision
+		m.hosts[decision.Host] = known
+	}
+	known.Action, known.Pattern, known.Source = decision.Action, decision.Pattern, decision.Source
+	known.Count++
+	known.LastSeen = time.Now().Unix()
+}
+
+// evict drops the host seen longest ago
+func (m *mitmHosts) evict() {
+	oldest := ""
+	for host, decision := range m.hosts {
+		if oldest == "" || decision.LastSeen < m.hosts[oldest].LastSeen {
+			oldest = host
+		}
+	}
+	delete(m.hosts, oldest)
+}
+
+// list returns the remembered hosts, the most recent first
+func (m *mitmHosts) list() []MitmDecision {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]MitmDecision, 0, len(m.hosts))
+	for _, decision := range m.hosts {
+		list = append(list, *decision)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].LastSeen != list[j].LastSeen {
+			return list[i].LastSeen > list[j].LastSeen
+		}
+		return list[i].Host < list[j].Host
+	})
+	return list
+}
+
+// handleConnect applies the MITM rules to a CONNECT
+func (p *Proxy) handleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	decision := EvaluateMitm(host)
+	switch decision.Action {
+	case MitmTunnel:
+		p.skipped.add(decision)
+		return goproxy.OkConnect, host
+	case MitmReject:
+		p.skipped.add(decision)
+		return goproxy.RejectConnect, host
+	}
+	return goproxy.MitmConnect, host
+}
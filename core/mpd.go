@@ -0,0 +1,457 @@
+package core
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type mpdDocument struct {
+	Type                      string      `xml:"type,attr"`
+	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURL                   string      `xml:"BaseURL"`
+	Periods                   []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Id             string             `xml:"id,attr"`
+	Duration       string             `xml:"duration,attr"`
+	BaseURL        string             `xml:"BaseURL"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	MimeType        string              `xml:"mimeType,attr"`
+	ContentType     string              `xml:"contentType,attr"`
+	Codecs          string              `xml:"codecs,attr"`
+	Lang            string              `xml:"lang,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	Id              string              `xml:"id,attr"`
+	Bandwidth       int64               `xml:"bandwidth,attr"`
+	Width           int                 `xml:"width,attr"`
+	Height          int                 `xml:"height,attr"`
+	Codecs          string              `xml:"codecs,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+}
+
+type mpdSegmentTemplate struct {
+	Media                  string              `xml:"media,attr"`
+	Initialization         string              `xml:"initialization,attr"`
+	StartNumber            *int64              `xml:"startNumber,attr"`
+	Timescale              int64               `xml:"timescale,attr"`
+	Duration               int64               `xml:"duration,attr"`
+	PresentationTimeOffset int64               `xml:"presentationTimeOffset,attr"`
+	SegmentTimeline        *mpdSegmentTimeline `xml:"SegmentTimeline"`
+}
+
+type mpdSegmentTimeline struct {
+	S []struct {
+		T *int64 `xml:"t,attr"`
+		D int64  `xml:"d,attr"`
+		R int64  `xml:"r,attr"`
+	} `xml:"S"`
+}
+
+type mpdUrl struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr"`
+}
+
+type mpdSegmentList struct {
+	Timescale      int64   `xml:"timescale,attr"`
+	Duration       int64   `xml:"duration,attr"`
+	Initialization *mpdUrl `xml:"Initialization"`
+	SegmentURLs    []struct {
+		Media      string `xml:"media,attr"`
+		MediaRange string `xml:"mediaRange,attr"`
+	} `xml:"SegmentURL"`
+}
+
+type mpdSegmentBase struct {
+	IndexRange     string  `xml:"indexRange,attr"`
+	Initialization *mpdUrl `xml:"Initialization"`
+}
+
+// DashRepresentation is one selectable rendition of a DASH manifest
+type DashRepresentation struct {
+	Id        string `json:"Id"`
+	Kind      string `json:"Kind"`
+	Bandwidth int64  `json:"Bandwidth"`
+	Width     int    `json:"Width"`
+	Height    int    `json:"Height"`
+	Codecs    string `json:"Codecs"`
+	MimeType  string `json:"MimeType"`
+	Lang      string `json:"Lang"`
+}
+
+// DashManifest is a parsed static MPD, only the kinds video and audio are kept
+type DashManifest struct {
+	Url             string
+	Dynamic         bool
+	Duration        float64
+	Representations []DashRepresentation
+	doc             *mpdDocument
+}
+
+func ParseMpd(content []byte, manifestUrl string) (*DashManifest, error) {
+	doc := &mpdDocument{}
+	if err := xml.Unmarshal(content, doc); err != nil {
+		return nil, fmt.Errorf("MPD 解析失败: %w", err)
+	}
+	manifest := &DashManifest{
+		Url:     manifestUrl,
+		Dynamic: doc.Type == "dynamic",
+		doc:     doc,
+	}
+	manifest.Duration, _ = parseIsoDuration(doc.MediaPresentationDuration)
+	if len(doc.Periods) == 0 {
+		return nil, fmt.Errorf("MPD 未包含 Period")
+	}
+
+	seen := make(map[string]bool)
+	for _, period := range doc.Periods {
+		for _, adaptation := range period.AdaptationSets {
+			for _, representation := range adaptation.Representations {
+				kind := mpdKind(adaptation, representation)
+				if kind == "" || seen[representation.Id] {
+					continue
+				}
+				seen[representation.Id] = true
+				item := DashRepresentation{
+					Id:        representation.Id,
+					Kind:      kind,
+					Bandwidth: representation.Bandwidth,
+					Width:     representation.Width,
+					Height:    representation.Height,
+					Codecs:    firstNonEmpty(representation.Codecs, adaptation.Codecs),
+					MimeType:  firstNonEmpty(representation.MimeType, adaptation.MimeType),
+					Lang:      adaptation.Lang,
+				}
+				manifest.Representations = append(manifest.Representations, item)
+			}
+		}
+	}
+	sort.SliceStable(manifest.Representations, func(i, j int) bool {
+		return manifest.Representations[i].Bandwidth > manifest.Representations[j].Bandwidth
+	})
+	return manifest, nil
+}
+
+func mpdKind(adaptation mpdAdaptationSet, representation mpdRepresentation) string {
+	for _, value := range []string{adaptation.ContentType, representation.MimeType, adaptation.MimeType} {
+		switch {
+		case strings.HasPrefix(value, "video"):
+			return "video"
+		case strings.HasPrefix(value, "audio"):
+			return "audio"
+		}
+	}
+	return ""
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Select returns the representation with the given id, or the highest bandwidth one of the kind
+func (m *DashManifest) Select(kind, id string) *DashRepresentation {
+	var best *DashRepresentation
+	for i := range m.Representations {
+		representation := &m.Representations[i]
+		if representation.Kind != kind {
+			continue
+		}
+		if id != "" && representation.Id == id {
+			return representation
+		}
+		if best == nil {
+			best = representation
+		}
+	}
+	return best
+}
+
+// Segments lists the initialization and media segments of a representation across all periods as a playlist
+func (m *DashManifest) Segments(representation *DashRepresentation) (*M3u8Playlist, error) {
+	base, err := url.Parse(m.Url)
+	if err != nil {
+		return nil, err
+	}
+	base = resolveBase(base, m.doc.BaseURL)
+	playlist := &M3u8Playlist{EndList: true}
+	for i, period := range m.doc.Periods {
+		periodDuration, ok := parseIsoDuration(period.Duration)
+		if !ok && len(m.doc.Periods) == 1 {
+			periodDuration = m.Duration
+		}
+		periodBase := resolveBase(base, period.BaseURL)
+		adaptation, selected := findRepresentation(period, representation)
+		if selected == nil {
+			globalLogger.Warn().Msgf("period %d has no %s representation", i, representation.Kind)
+			continue
+		}
+		repBase := resolveBase(resolveBase(periodBase, adaptation.BaseURL), selected.BaseURL)
+		segments, err := mpdSegments(adaptation, selected, repBase, periodDuration)
+		if err != nil {
+			return nil, err
+		}
+		for _, segment := range segments {
+			segment.Sequence = int64(len(playlist.Segments))
+			playlist.Segments = append(playlist.Segments, segment)
+		}
+	}
+	if len(playlist.Segments) == 0 {
+		return nil, fmt.Errorf("MPD 未包含分片")
+	}
+	return playlist, nil
+}
+
+// findRepresentation locates the representation in a period by id, falling back to the closest bandwidth of the same kind
+func findRepresentation(period mpdPeriod, want *DashRepresentation) (*mpdAdaptationSet, *mpdRepresentation) {
+	var adaptationMatch *mpdAdaptationSet
+	var match *mpdRepresentation
+	var distance int64 = math.MaxInt64
+	for i := range period.AdaptationSets {
+		adaptation := &period.AdaptationSets[i]
+		for j := range adaptation.Representations {
+			representation := &adaptation.Representations[j]
+			if mpdKind(*adaptation, *representation) != want.Kind {
+				continue
+			}
+			if representation.Id == want.Id {
+				return adaptation, representation
+			}
+			if d := abs64(representation.Bandwidth - want.Bandwidth); d < distance {
+				adaptationMatch, match, distance = adaptation, representation, d
+			}
+		}
+	}
+	return adaptationMatch, match
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func resolveBase(base *url.URL, ref string) *url.URL {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return base
+	}
+	parsed, err := url.Parse(ref)
+	if err != nil {
+		return base
+	}
+	return base.ResolveReference(parsed)
+}
+
+func mpdSegments(adaptation *mpdAdaptationSet, representation *mpdRepresentation, base *url.URL, periodDuration float64) ([]*M3u8Segment, error) {
+	if template := mergeTemplate(adaptation.SegmentTemplate, representation.SegmentTemplate); template != nil {
+		return templateSegments(template, representation, base, periodDuration)
+	}
+	if list := firstList(representation.SegmentList, adaptation.SegmentList); list != nil {
+		var initMap *M3u8Map
+		if list.Initialization != nil {
+			initMap = &M3u8Map{Url: resolveUrl(base, list.Initialization.SourceURL)}
+			initMap.ByteRange = parseMpdRange(list.Initialization.Range)
+		}
+		segments := make([]*M3u8Segment, 0, len(list.SegmentURLs))
+		for _, item := range list.SegmentURLs {
+			segments = append(segments, &M3u8Segment{
+				Url:       resolveUrl(base, item.Media),
+				Duration:  float64(list.Duration) / float64(max(1, list.Timescale)),
+				Map:       initMap,
+				ByteRange: parseMpdRange(item.MediaRange),
+			})
+		}
+		return segments, nil
+	}
+	// SegmentBase or a bare BaseURL: the representation is one self-contained file
+	return []*M3u8Segment{{Url: base.String(), Duration: periodDuration}}, nil
+}
+
+func firstList(lists ...*mpdSegmentList) *mpdSegmentList {
+	for _, list := range lists {
+		if list != nil {
+			return list
+		}
+	}
+	return nil
+}
+
+// mergeTemplate lets a representation's template inherit the attributes of its adaptation set
+func mergeTemplate(parent, child *mpdSegmentTemplate) *mpdSegmentTemplate {
+	if child == nil {
+		return parent
+	}
+	if parent == nil {
+		return child
+	}
+	merged := *child
+	if merged.Media == "" {
+		merged.Media = parent.Media
+	}
+	if merged.Initialization == "" {
+		merged.Initialization = parent.Initialization
+	}
+	if merged.StartNumber == nil {
+		merged.StartNumber = parent.StartNumber
+	}
+	if merged.Timescale == 0 {
+		merged.Timescale = parent.Timescale
+	}
+	if merged.Duration == 0 {
+		merged.Duration = parent.Duration
+	}
+	if merged.PresentationTimeOffset == 0 {
+		merged.PresentationTimeOffset = parent.PresentationTimeOffset
+	}
+	if merged.SegmentTimeline == nil {
+		merged.SegmentTimeline = parent.SegmentTimeline
+	}
+	return &merged
+}
+
+var mpdIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time)(%0(\d+)d)?\$`)
+
+func expandTemplate(template string, representation *mpdRepresentation, number, time int64) string {
+	expanded := mpdIdentifier.ReplaceAllStringFunc(template, func(match string) string {
+		parts := mpdIdentifier.FindStringSubmatch(match)
+		var value string
+		switch parts[1] {
+		case "RepresentationID":
+			return representation.Id
+		case "Number":
+			value = strconv.FormatInt(number, 10)
+		case "Bandwidth":
+			value = strconv.FormatInt(representation.Bandwidth, 10)
+		case "Time":
+			value = strconv.FormatInt(time, 10)
+		}
+		if width, err := strconv.Atoi(parts[3]); err == nil && len(value) < width {
+			value = strings.Repeat("0", width-len(value)) + value
+		}
+		return value
+	})
+	return strings.ReplaceAll(expanded, "$$", "$")
+}
+
+func templateSegments(template *mpdSegmentTemplate, representation *mpdRepresentation, base *url.URL, periodDuration float64) ([]*M3u8Segment, error) {
+	timescale := template.Timescale
+	if timescale <= 0 {
+		timescale = 1
+	}
+	number := int64(1)
+	if template.StartNumber != nil {
+		number = *template.StartNumber
+	}
+	var initMap *M3u8Map
+	if template.Initialization != "" {
+		initMap = &M3u8Map{Url: resolveUrl(base, expandTemplate(template.Initialization, representation, 0, 0))}
+	}
+	var segments []*M3u8Segment
+	add := func(time, duration int64) {
+		segments = append(segments, &M3u8Segment{
+			Url:      resolveUrl(base, expandTemplate(template.Media, representation, number, time)),
+			Duration: float64(duration) / float64(timescale),
+			Map:      initMap,
+		})
+		number++
+	}
+
+	if template.SegmentTimeline != nil {
+		end := template.PresentationTimeOffset + int64(periodDuration*float64(timescale))
+		time := template.PresentationTimeOffset
+		entries := template.SegmentTimeline.S
+		for i, entry := range entries {
+			if entry.T != nil {
+				time = *entry.T
+			}
+			if entry.D <= 0 {
+				return nil, fmt.Errorf("SegmentTimeline 时长错误")
+			}
+			repeat := entry.R
+			if repeat < 0 {
+				// repeat until the next entry or the end of the period
+				until := end
+				if i+1 < len(entries) && entries[i+1].T != nil {
+					until = *entries[i+1].T
+				}
+				repeat = int64(math.Ceil(float64(until-time)/float64(entry.D))) - 1
+			}
+			for r := int64(0); r <= repeat; r++ {
+				add(time, entry.D)
+				time += entry.D
+			}
+		}
+		return segments, nil
+	}
+
+	if template.Duration <= 0 {
+		return nil, fmt.Errorf("SegmentTemplate 缺少时长")
+	}
+	if periodDuration <= 0 {
+		return nil, fmt.Errorf("无法确定 MPD 时长")
+	}
+	count := int64(math.Ceil(periodDuration * float64(timescale) / float64(template.Duration)))
+	for i := int64(0); i < count; i++ {
+		add(template.PresentationTimeOffset+i*template.Duration, template.Duration)
+	}
+	return segments, nil
+}
+
+// parseMpdRange converts "first-last" to a byte range
+func parseMpdRange(value string) *M3u8ByteRange {
+	first, last, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil
+	}
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if err1 != nil || err2 != nil || end < start {
+		return nil
+	}
+	return &M3u8ByteRange{Offset: start, Length: end - start + 1}
+}
+
+var isoDuration = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseIsoDuration reads the day and time parts of an ISO 8601 duration in seconds
+func parseIsoDuration(value string) (float64, bool) {
+	parts := isoDuration.FindStringSubmatch(strings.TrimSpace(value))
+	if parts == nil || value == "P" {
+		return 0, false
+	}
+	seconds := 0.0
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if parts[i+1] != "" {
+			v, _ := strconv.ParseFloat(parts[i+1], 64)
+			seconds += v * unit
+		}
+	}
+	return seconds, true
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestDashSegmentsTwoPeriods(t *testing.T) {
+	mpd := `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT8S">
+ <Period id="p0" duration="PT4S">
+  <AdaptationSet mimeType="video/mp4">
+   <SegmentTemplate initialization="p0/$RepresentationID$/init.mp4" media="p0/$RepresentationID$/$Number$.m4s" startNumber="1" timescale="1000" duration="2000"/>
+   <Representation id="v1" bandwidth="500000" width="640" height="360" codecs="avc1.64001f"/>
+  </AdaptationSet>
+  <AdaptationSet mimeType="audio/mp4">
+   <SegmentTemplate initialization="p0/$RepresentationID$/init.mp4" media="p0/$RepresentationID$/$Number$.m4s" startNumber="1" timescale="1000" duration="2000"/>
+   <Representation id="a1" bandwidth="128000" codecs="mp4a.40.2"/>
+  </AdaptationSet>
+ </Period>
+ <Period id="p1" duration="PT4S">
+  <AdaptationSet mimeType="video/mp4">
+   <SegmentTemplate initialization="p1/$RepresentationID$/init.mp4" media="p1/$RepresentationID$/$Number$.m4s" startNumber="1" timescale="1000" duration="2000"/>
+   <Representation id="v1" bandwidth="500000" width="640" height="360" codecs="avc1.64001f"/>
+  </AdaptationSet>
+  <AdaptationSet mimeType="audio/mp4">
+   <SegmentTemplate initialization="p1/$RepresentationID$/init.mp4" media="p1/$RepresentationID$/$Number$.m4s" startNumber="1" timescale="1000" duration="2000"/>
+   <Representation id="a1" bandwidth="128000" codecs="mp4a.40.2"/>
+  </AdaptationSet>
+ </Period>
+</MPD>`
+	manifest, err := ParseMpd([]byte(mpd), "https://example.com/dash/a.mpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{"video", "audio"} {
+		representation := manifest.Select(kind, "")
+		if representation == nil {
+			t.Fatalf("no %s representation", kind)
+		}
+		playlist, err := manifest.Segments(representation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(playlist.Segments) != 4 {
+			t.Fatalf("%s has %d segments, want 4", kind, len(playlist.Segments))
+		}
+		for i, segment := range playlist.Segments {
+			period := "p0"
+			if i >= 2 {
+				period = "p1"
+			}
+			want := "https://example.com/dash/" + period + "/" + representation.Id + "/" + string(rune('1'+i%2)) + ".m4s"
+			if segment.Url != want {
+				t.Errorf("%s segment %d = %s, want %s", kind, i, segment.Url, want)
+			}
+			wantMap := "https://example.com/dash/" + period + "/" + representation.Id + "/init.mp4"
+			if segment.Map == nil || segment.Map.Url != wantMap {
+				t.Errorf("%s segment %d has map %+v, want %s", kind, i, segment.Map, wantMap)
+			}
+			if segment.Sequence != int64(i) {
+				t.Errorf("%s segment %d has sequence %d", kind, i, segment.Sequence)
+			}
+		}
+	}
+}
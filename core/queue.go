@@ -0,0 +1,134 @@
+package core
+
+import (
+	"sync"
+)
+
+type QueueItem struct {
+	MediaInfo MediaInfo       `json:"MediaInfo"`
+	Options   DownloadOptions `json:"-"`
+	Priority  int             `json:"Priority"`
+}
+
+// DownloadQueue holds waiting downloads ordered by priority, FIFO within the same priority
+type DownloadQueue struct {
+	mu      sync.Mutex
+	items   []*QueueItem
+	running map[string]bool
+}
+
+func initQueue() *DownloadQueue {
+	if queueOnce == nil {
+		queueOnce = &DownloadQueue{
+			items:   make([]*QueueItem, 0),
+			running: make(map[string]bool),
+		}
+	}
+	return queueOnce
+}
+
+func (q *DownloadQueue) maxRunning() int {
+	if globalConfig.MaxDownloads <= 0 {
+		return 1
+	}
+	return globalConfig.MaxDownloads
+}
+
+func (q *DownloadQueue) indexOf(id string) int {
+	for i, item := range q.items {
+		if item.MediaInfo.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// push adds a download behind every waiting item of the same or higher priority, it returns false if the resource is already queued or running
+func (q *DownloadQueue) push(mediaInfo MediaInfo, options DownloadOptions) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.running[mediaInfo.Id] || q.indexOf(mediaInfo.Id) >= 0 {
+		return false
+	}
+	item := &QueueItem{
+		MediaInfo: mediaInfo,
+		Options:   options,
+		Priority:  options.Priority,
+	}
+	index := 0
+	for i, queued := range q.items {
+		if queued.Priority >= item.Priority {
+			index = i + 1
+		}
+	}
+	q.insert(index, item)
+	return true
+}
+
+func (q *DownloadQueue) insert(index int, item *QueueItem) {
+	q.items = append(q.items, nil)
+	copy(q.items[index+1:], q.items[index:])
+	q.items[index] = item
+}
+
+// remove takes a waiting download out of the queue
+func (q *DownloadQueue) remove(id string) (*QueueItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	index := q.indexOf(id)
+	if index < 0 {
+		return nil, false
+	}
+	item := q.items[index]
+	q.items = append(q.items[:index], q.items[index+1:]...)
+	return item, true
+}
+
+// move places a waiting download at the given position, 0 being the next to start
+func (q *DownloadQueue) move(id string, to int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	index := q.indexOf(id)
+	if index < 0 {
+		return false
+	}
+	item := q.items[index]
+	q.items = append(q.items[:index], q.items[index+1:]...)
+	to = max(0, min(to, len(q.items)))
+	q.insert(to, item)
+	return true
+}
+
+func (q *DownloadQueue) list() []QueueItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]QueueItem, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, *item)
+	}
+	return items
+}
+
+func (q *DownloadQueue) runningCount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.running)
+}
+
+// schedule starts waiting downloads until the concurrency limit is reached
+func (q *DownloadQueue) schedule() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.running) < q.maxRunning() && len(q.items) > 0 {
+		item := q.items[0]
+		q.items = q.items[1:]
+		q.running[item.MediaInfo.Id] = true
+		go func(item *QueueItem) {
+			resourceOnce.run(item.MediaInfo, item.Options)
+			q.mu.Lock()
+			delete(q.running, item.MediaInfo.Id)
+			q.mu.Unlock()
+			q.schedule()
+		}(item)
+	}
+}
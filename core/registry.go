@@ -0,0 +1,178 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+var (
+	errDownloadPaused    = errors.New("download paused")
+	errDownloadCancelled = errors.New("download cancelled")
+)
+
+type downloadEntry struct {
+	mediaInfo  MediaInfo
+	options    DownloadOptions
+	status     string
+	deleteFile bool
+	cancel     context.CancelCauseFunc
+	limiter    *RateLimiter
+}
+
+// register adds a running download to the registry, it returns false when the resource is already downloading
+func (r *Resource) register(mediaInfo MediaInfo, options DownloadOptions, cancel context.CancelCauseFunc, limiter *RateLimiter) bool {
+	r.downloadsMu.Lock()
+	defer r.downloadsMu.Unlock()
+	if entry, ok := r.downloads[mediaInfo.Id]; ok && entry.status == DownloadStatusRunning {
+		return false
+	}
+	r.downloads[mediaInfo.Id] = &downloadEntry{
+		mediaInfo: mediaInfo,
+		options:   options,
+		status:    DownloadStatusRunning,
+		cancel:    cancel,
+		limiter:   limiter,
+	}
+	return true
+}
+
+func (r *Resource) unregister(id string) {
+	r.downloadsMu.Lock()
+	defer r.downloadsMu.Unlock()
+	delete(r.downloads, id)
+}
+
+func (r *Resource) getDownload(id string) (*downloadEntry, bool) {
+	r.downloadsMu.Lock()
+	defer r.downloadsMu.Unlock()
+	entry, ok := r.downloads[id]
+	return entry, ok
+}
+
+// setDownloadStatus also stores the media info, the save path may have changed while downloading
+func (r *Resource) setDownloadStatus(mediaInfo MediaInfo, status string) {
+	r.downloadsMu.Lock()
+	defer r.downloadsMu.Unlock()
+	if entry, ok := r.downloads[mediaInfo.Id]; ok {
+		entry.mediaInfo = mediaInfo
+		entry.status = status
+	}
+}
+
+func (r *Resource) pause(id string) bool {
+	if item, ok := queueOnce.remove(id); ok {
+		r.downloadsMu.Lock()
+		r.downloads[id] = &downloadEntry{
+			mediaInfo: item.MediaInfo,
+			options:   item.Options,
+			status:    DownloadStatusPaused,
+			// the speed can still be changed while paused, resume picks it up from the limiter
+			limiter: NewRateLimiter(int64(item.Options.SpeedLimit) * 1024),
+		}
+		r.downloadsMu.Unlock()
+		r.progressEventsEmit(item.MediaInfo, "已暂停", DownloadStatusPaused)
+		return true
+	}
+	r.downloadsMu.Lock()
+	defer r.downloadsMu.Unlock()
+	entry, ok := r.downloads[id]
+	if !ok || entry.status != DownloadStatusRunning {
+		return false
+	}
+	entry.cancel(errDownloadPaused)
+	return true
+}
+
+// stop ends a live recording and keeps what was recorded
+func (r *Resource) stop(id string) bool {
+	r.downloadsMu.Lock()
+	defer r.downloadsMu.Unlock()
+	entry, ok := r.downloads[id]
+	if !ok || entry.status != DownloadStatusRunning {
+		return false
+	}
+	entry.cancel(errRecordStopped)
+	return true
+}
+
+func (r *Resource) resume(id string) bool {
+	if entry, ok := r.getDownload(id); ok {
+		if entry.status != DownloadStatusPaused {
+			return false
+		}
+		options := entry.options
+		options.SavePath = entry.mediaInfo.SavePath
+		if entry.limiter != nil {
+			options.SpeedLimit = int(entry.limiter.Rate() / 1024)
+		}
+		r.download(entry.mediaInfo, options)
+		return true
+	}
+	if journal, ok := r.getJournal(id); ok {
+		r.download(journal.MediaInfo, DownloadOptions{DecodeStr: journal.DecodeStr})
+		return true
+	}
+	return false
+}
+
+// setSpeedLimit changes the speed cap of a download while it runs, 0 removes the cap
+func (r *Resource) setSpeedLimit(id string, speedLimit int) bool {
+	entry, ok := r.getDownload(id)
+	if !ok {
+		return false
+	}
+	entry.limiter.SetRate(int64(speedLimit) * 1024)
+	return true
+}
+
+func (r *Resource) cancel(id string, deleteFile bool) bool {
+	if item, ok := queueOnce.remove(id); ok {
+		r.progressEventsEmit(item.MediaInfo, "已取消", DownloadStatusCancelled)
+		return true
+	}
+	r.downloadsMu.Lock()
+	entry, ok := r.downloads[id]
+	if ok && entry.status == DownloadStatusRunning {
+		entry.deleteFile = deleteFile
+		entry.cancel(errDownloadCancelled)
+		r.downloadsMu.Unlock()
+		return true
+	}
+	delete(r.downloads, id)
+	r.downloadsMu.Unlock()
+
+	// nothing is running, clean up what a paused or interrupted download left behind
+	mediaInfo := MediaInfo{Id: id}
+	if ok {
+		mediaInfo = entry.mediaInfo
+	} else if journal, exists := r.getJournal(id); exists {
+		mediaInfo = journal.MediaInfo
+		mediaInfo.SavePath = journal.FileName
+	} else {
+		return false
+	}
+	r.discard(mediaInfo, deleteFile)
+	r.progressEventsEmit(mediaInfo, "已取消", DownloadStatusCancelled)
+	return true
+}
+
+// discard drops the journal of a cancelled download and optionally its partial file and segments
+func (r *Resource) discard(mediaInfo MediaInfo, deleteFile bool) {
+	if mediaInfo.SavePath != "" {
+		if journal, err := LoadJournal(mediaInfo.SavePath); err == nil {
+			journal.Remove()
+		}
+		if deleteFile {
+			_ = os.Remove(mediaInfo.SavePath + PartSuffix)
+			_ = os.RemoveAll(mediaInfo.SavePath + HlsSegmentsSuffix)
+			for _, trackFile := range dashTrackFiles(mediaInfo.SavePath) {
+				_ = os.Remove(trackFile)
+				_ = os.RemoveAll(trackFile + HlsSegmentsSuffix)
+			}
+		}
+	}
+	r.journalsMu.Lock()
+	delete(r.journals, mediaInfo.Id)
+	r.journalsMu.Unlock()
+}
@@ -0,0 +1,449 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errRemuxFormat = errors.New("不支持的格式，仅支持 MPEG-TS 与 FLV 中的 H.264/AAC")
+
+// remuxSample points into the temporary mdat file, timestamps are in the track timescale
+type remuxSample struct {
+	offset int64
+	size   uint32
+	dts    int64
+	cts    int64
+	key    bool
+}
+
+type remuxTrack struct {
+	id        uint32
+	video     bool
+	timescale uint32
+	samples   []remuxSample
+
+	// sampleEntry is copied from a MP4 source as is, otherwise it is built from the codec configuration
+	sampleEntry []byte
+
+	// video
+	avcC   []byte
+	sps    []byte
+	pps    []byte
+	width  int
+	height int
+
+	// audio
+	asc        []byte
+	sampleRate int
+	channels   int
+}
+
+// remuxer collects the elementary stream samples of a demuxer into a temporary file before the MP4 is written
+type remuxer struct {
+	data  *os.File
+	size  int64
+	video *remuxTrack
+	audio *remuxTrack
+}
+
+func newRemuxer(dataFile string) (*remuxer, error) {
+	data, err := os.Create(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	return &remuxer{data: data}, nil
+}
+
+func (m *remuxer) videoTrack() *remuxTrack {
+	if m.video == nil {
+		m.video = &remuxTrack{video: true, timescale: 90000}
+	}
+	return m.video
+}
+
+func (m *remuxer) audioTrack() *remuxTrack {
+	if m.audio == nil {
+		m.audio = &remuxTrack{}
+	}
+	return m.audio
+}
+
+func (m *remuxer) writeSample(track *remuxTrack, data []byte, dts, cts int64, key bool) error {
+	if track.video && len(track.samples) == 0 && !key {
+		// a decoder cannot start before the first key frame
+		return nil
+	}
+	if _, err := m.data.Write(data); err != nil {
+		return err
+	}
+	track.samples = append(track.samples, remuxSample{
+		offset: m.size,
+		size:   uint32(len(data)),
+		dts:    dts,
+		cts:    cts,
+		key:    key,
+	})
+	m.size += int64(len(data))
+	return nil
+}
+
+func (m *remuxer) close() {
+	if m.data != nil {
+		_ = m.data.Close()
+		_ = os.Remove(m.data.Name())
+		m.data = nil
+	}
+}
+
+// remuxFormat sniffs the container of a file, it returns "ts", "flv" or an empty string
+func remuxFormat(header []byte) string {
+	if len(header) >= 3 && string(header[:3]) == "FLV" {
+		return "flv"
+	}
+	if len(header) > tsPacketSize && header[0] == 0x47 && header[tsPacketSize] == 0x47 {
+		return "ts"
+	}
+	return ""
+}
+
+// RemuxFile rewrites a MPEG-TS or FLV file as MP4 without re-encoding, dst may equal src
+func RemuxFile(src, dst string) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	reader := bufio.NewReaderSize(source, 1<<20)
+	header, _ := reader.Peek(tsPacketSize + 1)
+
+	m, err := newRemuxer(dst + ".remux")
+	if err != nil {
+		return err
+	}
+	defer m.close()
+	switch remuxFormat(header) {
+	case "ts":
+		err = demuxTs(reader, m)
+	case "flv":
+		err = demuxFlv(reader, m)
+	default:
+		err = errRemuxFormat
+	}
+	if err != nil {
+		return err
+	}
+	source.Close()
+	return m.writeTo(dst)
+}
+
+// MuxFragmented joins the tracks of fragmented MP4 files, such as the video and audio of a DASH stream, into one MP4
+func MuxFragmented(dst string, inputs ...string) error {
+	m, err := newRemuxer(dst + ".remux")
+	if err != nil {
+		return err
+	}
+	defer m.close()
+	for _, input := range inputs {
+		if err = demuxFmp4(input, m); err != nil {
+			return err
+		}
+	}
+	return m.writeTo(dst)
+}
+
+// writeTo writes the collected tracks as a progressive MP4 with the index in front
+func (m *remuxer) writeTo(dst string) error {
+	var err error
+	tracks := make([]*remuxTrack, 0, 2)
+	for _, track := range []*remuxTrack{m.video, m.audio} {
+		if track != nil && len(track.samples) > 0 {
+			track.id = uint32(len(tracks) + 1)
+			tracks = append(tracks, track)
+		}
+	}
+	if len(tracks) == 0 {
+		return fmt.Errorf("未找到 H.264/AAC 数据")
+	}
+	if m.video != nil && len(m.video.samples) > 0 && m.video.avcC == nil && m.video.sampleEntry == nil {
+		if m.video.avcC, err = buildAvcC(m.video.sps, m.video.pps); err != nil {
+			return err
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	tmpFile := dst + ".mp4.part"
+	if err = writeMp4(tmpFile, m, tracks); err != nil {
+		_ = os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, dst)
+}
+
+// RemuxPath is the MP4 file a capture is remuxed to, numbered when that name is taken
+func RemuxPath(src string) string {
+	return availablePath(strings.TrimSuffix(src, filepath.Ext(src)) + ".mp4")
+}
+
+func writeMp4(fileName string, m *remuxer, tracks []*remuxTrack) error {
+	ftyp := mp4Box("ftyp", []byte("isom"), be32(512), []byte("isomiso2avc1mp41"))
+	mdatHeader := 8
+	if m.size+8 > 0xFFFFFFFF {
+		mdatHeader = 16
+	}
+	// the data offsets depend on the size of the moov box, which grows when they no longer fit stco,
+	// so it is rebuilt until it is built with the offsets of its own size
+	moov := buildMoov(tracks, int64(len(ftyp)+mdatHeader))
+	for {
+		next := buildMoov(tracks, int64(len(ftyp)+len(moov)+mdatHeader))
+		if len(next) == len(moov) {
+			moov = next
+			break
+		}
+		moov = next
+	}
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriterSize(file, 1<<20)
+	writer.Write(ftyp)
+	writer.Write(moov)
+	if mdatHeader == 16 {
+		writer.Write(be32(1))
+		writer.WriteString("mdat")
+		writer.Write(be64(uint64(m.size + 16)))
+	} else {
+		writer.Write(be32(uint32(m.size + 8)))
+		writer.WriteString("mdat")
+	}
+	if _, err = m.data.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err = io.Copy(writer, m.data); err != nil {
+		return err
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// trackTiming returns when a track starts presenting in seconds and the composition offset of its first sample
+func trackTiming(track *remuxTrack) (float64, int64) {
+	first := track.samples[0]
+	return float64(first.dts+first.cts) / float64(track.timescale), first.cts
+}
+
+// sampleDuration is the decode duration of the sample, the last one repeats the previous duration
+func sampleDuration(track *remuxTrack, i int) uint32 {
+	samples := track.samples
+	if i+1 < len(samples) {
+		delta := samples[i+1].dts - samples[i].dts
+		if delta <= 0 {
+			delta = 1
+		}
+		return uint32(delta)
+	}
+	if i > 0 {
+		return sampleDuration(track, i-1)
+	}
+	if track.video {
+		return track.timescale / 25
+	}
+	return 1024
+}
+
+func mediaDuration(track *remuxTrack) int64 {
+	samples := track.samples
+	last := len(samples) - 1
+	return samples[last].dts - samples[0].dts + int64(sampleDuration(track, last))
+}
+
+const mp4MovieTimescale = 1000
+
+func buildMoov(tracks []*remuxTrack, dataOffset int64) []byte {
+	start := -1.0
+	for _, track := range tracks {
+		if trackStart, _ := trackTiming(track); start < 0 || trackStart < start {
+			start = trackStart
+		}
+	}
+	var traks [][]byte
+	var movieDuration int64
+	for _, track := range tracks {
+		trackStart, mediaTime := trackTiming(track)
+		emptyDuration := int64((trackStart - start) * mp4MovieTimescale)
+		presented := mediaDuration(track) - mediaTime
+		duration := emptyDuration + presented*mp4MovieTimescale/int64(track.timescale)
+		movieDuration = max(movieDuration, duration)
+		traks = append(traks, buildTrak(track, dataOffset, emptyDuration, mediaTime, duration))
+	}
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		be32(0), be32(0), be32(mp4MovieTimescale), be32(uint32(movieDuration)),
+		be32(0x00010000), be16(0x0100), make([]byte, 10),
+		mp4Matrix(), make([]byte, 24), be32(uint32(len(tracks)+1)))
+	return mp4Box("moov", append([][]byte{mvhd}, traks...)...)
+}
+
+func mp4Matrix() []byte {
+	return bytes.Join([][]byte{
+		be32(0x00010000), be32(0), be32(0),
+		be32(0), be32(0x00010000), be32(0),
+		be32(0), be32(0), be32(0x40000000),
+	}, nil)
+}
+
+func buildTrak(track *remuxTrack, dataOffset, emptyDuration, mediaTime, duration int64) []byte {
+	volume, width, height := uint16(0x0100), 0, 0
+	if track.video {
+		volume, width, height = 0, track.width, track.height
+	}
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		be32(0), be32(0), be32(track.id), be32(0), be32(uint32(duration)),
+		make([]byte, 8), be16(0), be16(0), be16(volume), be16(0),
+		mp4Matrix(), be32(uint32(width)<<16), be32(uint32(height)<<16))
+
+	var edits [][]byte
+	if emptyDuration > 0 {
+		edits = append(edits, be32(uint32(emptyDuration)), be32(0xFFFFFFFF), be32(0x00010000))
+	}
+	edits = append(edits, be32(uint32(duration-emptyDuration)), be32(uint32(mediaTime)), be32(0x00010000))
+	elst := mp4FullBox("elst", 0, 0, append([][]byte{be32(uint32(len(edits) / 3))}, edits...)...)
+	edts := mp4Box("edts", elst)
+
+	mdhd := mp4FullBox("mdhd", 0, 0,
+		be32(0), be32(0), be32(track.timescale), be32(uint32(mediaDuration(track))),
+		be16(0x55C4), be16(0))
+	handler, name, header := "soun", "SoundHandler", mp4FullBox("smhd", 0, 0, be16(0), be16(0))
+	if track.video {
+		handler, name, header = "vide", "VideoHandler", mp4FullBox("vmhd", 0, 1, be16(0), make([]byte, 6))
+	}
+	hdlr := mp4FullBox("hdlr", 0, 0, be32(0), []byte(handler), make([]byte, 12), []byte(name), []byte{0})
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, be32(1), mp4FullBox("url ", 0, 1)))
+	minf := mp4Box("minf", header, dinf, buildStbl(track, dataOffset))
+	mdia := mp4Box("mdia", mdhd, hdlr, minf)
+	return mp4Box("trak", tkhd, edts, mdia)
+}
+
+func buildStbl(track *remuxTrack, dataOffset int64) []byte {
+	entry := track.sampleEntry
+	if entry != nil {
+		// copied from the source
+	} else if track.video {
+		entry = mp4Box("avc1",
+			make([]byte, 6), be16(1), make([]byte, 16),
+			be16(uint16(track.width)), be16(uint16(track.height)),
+			be32(0x00480000), be32(0x00480000), be32(0), be16(1),
+			make([]byte, 32), be16(0x0018), be16(0xFFFF),
+			mp4Box("avcC", track.avcC))
+	} else {
+		entry = mp4Box("mp4a",
+			make([]byte, 6), be16(1), make([]byte, 8),
+			be16(uint16(track.channels)), be16(16), be16(0), be16(0),
+			be32(uint32(track.sampleRate)<<16),
+			buildEsds(track.asc))
+	}
+	stsd := mp4FullBox("stsd", 0, 0, be32(1), entry)
+
+	samples := track.samples
+	var stts, ctts, stss, stsz, stco [][]byte
+	var sttsCount, cttsCount uint32
+	hasCts := false
+	for i, sample := range samples {
+		duration := sampleDuration(track, i)
+		if n := len(stts); n > 0 && bytes.Equal(stts[n-1], be32(duration)) {
+			sttsCount++
+			stts[n-2] = be32(sttsCount)
+		} else {
+			sttsCount = 1
+			stts = append(stts, be32(1), be32(duration))
+		}
+		if n := len(ctts); n > 0 && bytes.Equal(ctts[n-1], be32(uint32(sample.cts))) {
+			cttsCount++
+			ctts[n-2] = be32(cttsCount)
+		} else {
+			cttsCount = 1
+			ctts = append(ctts, be32(1), be32(uint32(sample.cts)))
+		}
+		hasCts = hasCts || sample.cts != 0
+		if sample.key {
+			stss = append(stss, be32(uint32(i+1)))
+		}
+		stsz = append(stsz, be32(sample.size))
+	}
+	large := dataOffset+samples[len(samples)-1].offset > 0xFFFFFFFF
+	for _, sample := range samples {
+		if large {
+			stco = append(stco, be64(uint64(dataOffset+sample.offset)))
+		} else {
+			stco = append(stco, be32(uint32(dataOffset+sample.offset)))
+		}
+	}
+
+	boxes := [][]byte{
+		stsd,
+		mp4FullBox("stts", 0, 0, append([][]byte{be32(uint32(len(stts) / 2))}, stts...)...),
+	}
+	if hasCts {
+		boxes = append(boxes, mp4FullBox("ctts", 0, 0, append([][]byte{be32(uint32(len(ctts) / 2))}, ctts...)...))
+	}
+	if track.video {
+		boxes = append(boxes, mp4FullBox("stss", 0, 0, append([][]byte{be32(uint32(len(stss)))}, stss...)...))
+	}
+	// every sample is its own chunk
+	boxes = append(boxes,
+		mp4FullBox("stsc", 0, 0, be32(1), be32(1), be32(1), be32(1)),
+		mp4FullBox("stsz", 0, 0, append([][]byte{be32(0), be32(uint32(len(samples)))}, stsz...)...),
+	)
+	stcoType := "stco"
+	if large {
+		stcoType = "co64"
+	}
+	boxes = append(boxes, mp4FullBox(stcoType, 0, 0, append([][]byte{be32(uint32(len(samples)))}, stco...)...))
+	return mp4Box("stbl", boxes...)
+}
+
+func buildEsds(asc []byte) []byte {
+	decoderSpecificInfo := mp4Descriptor(0x05, asc)
+	decoderConfig := mp4Descriptor(0x04, []byte{0x40, 0x15, 0, 0, 0}, be32(0), be32(0), decoderSpecificInfo)
+	slConfig := mp4Descriptor(0x06, []byte{0x02})
+	esDescriptor := mp4Descriptor(0x03, be16(1), []byte{0}, decoderConfig, slConfig)
+	return mp4FullBox("esds", 0, 0, esDescriptor)
+}
+
+func mp4Descriptor(tag byte, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	size := len(body)
+	return append([]byte{tag, byte(size>>21) | 0x80, byte(size>>14) | 0x80, byte(size>>7) | 0x80, byte(size) & 0x7F}, body...)
+}
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	return append(append(be32(uint32(len(body)+8)), boxType...), body...)
+}
+
+func mp4FullBox(boxType string, version byte, flags uint32, payload ...[]byte) []byte {
+	return mp4Box(boxType, append([][]byte{be32(uint32(version)<<24 | flags)}, payload...)...)
+}
+
+func be16(v uint16) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func be32(v uint32) []byte {
+	return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+func be64(v uint64) []byte {
+	return append(be32(uint32(v>>32)), be32(uint32(v))...)
+}
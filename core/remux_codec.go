@@ -0,0 +1,294 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// splitAnnexB returns the NAL units of a start code delimited H.264 byte stream
+func splitAnnexB(data []byte) [][]byte {
+	var units [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				end := i
+				// a four byte start code leaves a zero behind the previous unit
+				if end > start && data[end-1] == 0 {
+					end--
+				}
+				units = append(units, data[start:end])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 && start < len(data) {
+		units = append(units, data[start:])
+	}
+	return units
+}
+
+// annexBToAvcc converts an access unit to length prefixed NAL units, parameter sets are moved to the track
+func annexBToAvcc(track *remuxTrack, data []byte) ([]byte, bool) {
+	var sample []byte
+	key := false
+	for _, unit := range splitAnnexB(data) {
+		if len(unit) == 0 {
+			continue
+		}
+		switch unit[0] & 0x1F {
+		case 7:
+			if track.sps == nil {
+				track.sps = append([]byte{}, unit...)
+				track.width, track.height, _ = parseSps(unit)
+			}
+			continue
+		case 8:
+			if track.pps == nil {
+				track.pps = append([]byte{}, unit...)
+			}
+			continue
+		case 9:
+			continue
+		case 5:
+			key = true
+		}
+		sample = binary.BigEndian.AppendUint32(sample, uint32(len(unit)))
+		sample = append(sample, unit...)
+	}
+	return sample, key
+}
+
+// buildAvcC creates an AVCDecoderConfigurationRecord from the first parameter sets of the stream
+func buildAvcC(sps, pps []byte) ([]byte, error) {
+	if len(sps) < 4 || len(pps) == 0 {
+		return nil, errors.New("未找到 H.264 参数集")
+	}
+	record := []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(sps)))
+	record = append(record, sps...)
+	record = append(record, 1)
+	record = binary.BigEndian.AppendUint16(record, uint16(len(pps)))
+	return append(record, pps...), nil
+}
+
+// parseAvcC reads the first SPS of an AVCDecoderConfigurationRecord and the NAL length size
+func parseAvcC(record []byte) (sps []byte, lengthSize int, err error) {
+	if len(record) < 8 {
+		return nil, 0, errors.New("AVC 配置信息不完整")
+	}
+	lengthSize = int(record[4]&0x03) + 1
+	size := int(binary.BigEndian.Uint16(record[6:8]))
+	if record[5]&0x1F == 0 || len(record) < 8+size {
+		return nil, lengthSize, errors.New("AVC 配置信息不完整")
+	}
+	return record[8 : 8+size], lengthSize, nil
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (b *bitReader) bit() uint {
+	if b.pos >= len(b.data)*8 {
+		b.pos++
+		return 0
+	}
+	v := uint(b.data[b.pos/8]>>(7-b.pos%8)) & 1
+	b.pos++
+	return v
+}
+
+func (b *bitReader) bits(n int) uint {
+	var v uint
+	for i := 0; i < n; i++ {
+		v = v<<1 | b.bit()
+	}
+	return v
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (b *bitReader) ue() uint {
+	zeros := 0
+	for b.bit() == 0 && zeros < 32 {
+		zeros++
+	}
+	return (1<<zeros - 1) + b.bits(zeros)
+}
+
+func (b *bitReader) se() int {
+	v := b.ue()
+	if v&1 == 1 {
+		return int(v+1) / 2
+	}
+	return -int(v / 2)
+}
+
+func (b *bitReader) overrun() bool {
+	return b.pos > len(b.data)*8
+}
+
+// unescapeRbsp removes the emulation prevention bytes of a NAL unit
+func unescapeRbsp(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if i+2 < len(data) && data[i] == 0 && data[i+1] == 0 && data[i+2] == 3 {
+			out = append(out, 0, 0)
+			i += 2
+			continue
+		}
+		out = append(out, data[i])
+	}
+	return out
+}
+
+// parseSps returns the displayed picture size of a H.264 sequence parameter set
+func parseSps(sps []byte) (int, int, error) {
+	if len(sps) < 4 {
+		return 0, 0, errors.New("SPS 不完整")
+	}
+	b := &bitReader{data: unescapeRbsp(sps[1:])}
+	profile := b.bits(8)
+	b.bits(16) // constraint flags and level
+	b.ue()     // seq_parameter_set_id
+	chromaFormat := uint(1)
+	separateColourPlane := uint(0)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = b.ue()
+		if chromaFormat == 3 {
+			separateColourPlane = b.bit()
+		}
+		b.ue() // bit_depth_luma_minus8
+		b.ue() // bit_depth_chroma_minus8
+		b.bit()
+		if b.bit() == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if b.bit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + b.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	b.ue() // log2_max_frame_num_minus4
+	switch b.ue() {
+	case 0:
+		b.ue()
+	case 1:
+		b.bit()
+		b.se()
+		b.se()
+		cycle := b.ue()
+		for i := uint(0); i < cycle && !b.overrun(); i++ {
+			b.se()
+		}
+	}
+	b.ue()  // max_num_ref_frames
+	b.bit() // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := b.ue() + 1
+	heightInMapUnits := b.ue() + 1
+	frameMbsOnly := b.bit()
+	if frameMbsOnly == 0 {
+		b.bit()
+	}
+	b.bit() // direct_8x8_inference_flag
+	var cropLeft, cropRight, cropTop, cropBottom uint
+	if b.bit() == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = b.ue(), b.ue(), b.ue(), b.ue()
+	}
+	if b.overrun() {
+		return 0, 0, errors.New("SPS 不完整")
+	}
+	cropUnitX, cropUnitY := uint(1), 2-frameMbsOnly
+	if chromaFormat != 0 && separateColourPlane == 0 {
+		subWidth, subHeight := uint(2), uint(2)
+		if chromaFormat == 2 {
+			subHeight = 1
+		} else if chromaFormat == 3 {
+			subWidth, subHeight = 1, 1
+		}
+		cropUnitX, cropUnitY = subWidth, subHeight*(2-frameMbsOnly)
+	}
+	width := widthInMbs*16 - cropUnitX*(cropLeft+cropRight)
+	height := (2-frameMbsOnly)*heightInMapUnits*16 - cropUnitY*(cropTop+cropBottom)
+	return int(width), int(height), nil
+}
+
+// adtsHeader describes one AAC frame of an ADTS stream
+type adtsHeader struct {
+	headerSize int
+	frameSize  int
+	asc        []byte
+	sampleRate int
+	channels   int
+}
+
+func parseAdts(data []byte) (*adtsHeader, error) {
+	if len(data) < 7 || data[0] != 0xFF || data[1]&0xF6 != 0xF0 {
+		return nil, errors.New("ADTS 同步字错误")
+	}
+	profile := data[2]>>6 + 1
+	rateIndex := int(data[2] >> 2 & 0x0F)
+	channels := int(data[2]&0x01)<<2 | int(data[3]>>6)
+	frameSize := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5]>>5)
+	headerSize := 7
+	if data[1]&0x01 == 0 {
+		headerSize = 9
+	}
+	if rateIndex >= len(aacSampleRates) || frameSize < headerSize {
+		return nil, fmt.Errorf("ADTS 头错误")
+	}
+	return &adtsHeader{
+		headerSize: headerSize,
+		frameSize:  frameSize,
+		asc:        []byte{profile<<3 | byte(rateIndex>>1), byte(rateIndex&1)<<7 | byte(channels)<<3},
+		sampleRate: aacSampleRates[rateIndex],
+		channels:   channels,
+	}, nil
+}
+
+// parseAsc reads the sample rate and channel count of an AudioSpecificConfig
+func parseAsc(asc []byte) (int, int, error) {
+	if len(asc) < 2 {
+		return 0, 0, errors.New("AAC 配置信息不完整")
+	}
+	b := &bitReader{data: asc}
+	if b.bits(5) == 31 {
+		b.bits(6)
+	}
+	sampleRate := 0
+	if rateIndex := b.bits(4); rateIndex == 0x0F {
+		sampleRate = int(b.bits(24))
+	} else if int(rateIndex) < len(aacSampleRates) {
+		sampleRate = aacSampleRates[rateIndex]
+	}
+	channels := int(b.bits(4))
+	if sampleRate == 0 || b.overrun() {
+		return 0, 0, errors.New("AAC 配置信息错误")
+	}
+	return sampleRate, channels, nil
+}
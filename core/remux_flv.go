@@ -0,0 +1,134 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	flvTagAudio = 8
+	flvTagVideo = 9
+)
+
+// demuxFlv reads the AVC video and AAC audio tags of a FLV stream
+func demuxFlv(reader io.Reader, m *remuxer) error {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return errRemuxFormat
+	}
+	dataOffset := int64(binary.BigEndian.Uint32(header[5:9]))
+	// skip the rest of the header and PreviousTagSize0
+	if _, err := io.CopyN(io.Discard, reader, dataOffset-9+4); err != nil {
+		return errRemuxFormat
+	}
+
+	lengthSize := 4
+	audioStart := int64(-1)
+	tagHeader := make([]byte, 11)
+	for {
+		if _, err := io.ReadFull(reader, tagHeader); err != nil {
+			// a recording may end in the middle of a tag
+			return nil
+		}
+		tagType := tagHeader[0] & 0x1F
+		size := int(tagHeader[1])<<16 | int(tagHeader[2])<<8 | int(tagHeader[3])
+		timestamp := int64(tagHeader[7])<<24 | int64(tagHeader[4])<<16 | int64(tagHeader[5])<<8 | int64(tagHeader[6])
+		data := make([]byte, size+4)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil
+		}
+		data = data[:size]
+
+		switch tagType {
+		case flvTagVideo:
+			if len(data) < 5 {
+				continue
+			}
+			if data[0]&0x0F != 7 {
+				return errRemuxFormat
+			}
+			track := m.videoTrack()
+			switch data[1] {
+			case 0:
+				if track.avcC == nil {
+					track.avcC = append([]byte{}, data[5:]...)
+					sps, size, err := parseAvcC(track.avcC)
+					if err != nil {
+						return err
+					}
+					lengthSize = size
+					track.avcC[4] |= 0x03
+					track.width, track.height, _ = parseSps(sps)
+				}
+			case 1:
+				if track.avcC == nil {
+					continue
+				}
+				composition := int64(int32(uint32(data[2])<<24|uint32(data[3])<<16|uint32(data[4])<<8) >> 8)
+				sample, err := normalizeNalLength(data[5:], lengthSize)
+				if err != nil {
+					return err
+				}
+				key := data[0]>>4 == 1
+				if err = m.writeSample(track, sample, timestamp*90, max(0, composition*90), key); err != nil {
+					return err
+				}
+			}
+		case flvTagAudio:
+			if len(data) < 2 {
+				continue
+			}
+			if data[0]>>4 != 10 {
+				return errRemuxFormat
+			}
+			track := m.audioTrack()
+			switch data[1] {
+			case 0:
+				if track.asc == nil {
+					sampleRate, channels, err := parseAsc(data[2:])
+					if err != nil {
+						return err
+					}
+					track.asc = append([]byte{}, data[2:]...)
+					track.sampleRate = sampleRate
+					track.channels = channels
+					track.timescale = uint32(sampleRate)
+				}
+			case 1:
+				if track.asc == nil {
+					continue
+				}
+				if audioStart < 0 {
+					audioStart = timestamp * int64(track.sampleRate) / 1000
+				}
+				dts := audioStart + int64(len(track.samples))*1024
+				if err := m.writeSample(track, data[2:], dts, 0, true); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// normalizeNalLength rewrites NAL units to four byte length prefixes as declared by the generated sample entry
+func normalizeNalLength(data []byte, lengthSize int) ([]byte, error) {
+	if lengthSize == 4 {
+		return data, nil
+	}
+	var sample []byte
+	for len(data) >= lengthSize {
+		size := 0
+		for i := 0; i < lengthSize; i++ {
+			size = size<<8 | int(data[i])
+		}
+		data = data[lengthSize:]
+		if size > len(data) {
+			return nil, errors.New("NAL 长度错误")
+		}
+		sample = binary.BigEndian.AppendUint32(sample, uint32(size))
+		sample = append(sample, data[:size]...)
+		data = data[size:]
+	}
+	return sample, nil
+}
@@ -0,0 +1,335 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+var errFmp4Format = errors.New("不是分片 MP4 文件")
+
+type mp4BoxHeader struct {
+	boxType    string
+	offset     int64
+	size       int64
+	headerSize int64
+}
+
+// readBoxHeader reads the header of the box at offset, a size of 0 extends the box to the end of the file
+func readBoxHeader(file io.ReaderAt, offset, fileSize int64) (*mp4BoxHeader, error) {
+	buf := make([]byte, 16)
+	if _, err := file.ReadAt(buf[:8], offset); err != nil {
+		return nil, err
+	}
+	header := &mp4BoxHeader{
+		boxType:    string(buf[4:8]),
+		offset:     offset,
+		size:       int64(binary.BigEndian.Uint32(buf)),
+		headerSize: 8,
+	}
+	switch header.size {
+	case 0:
+		header.size = fileSize - offset
+	case 1:
+		if _, err := file.ReadAt(buf[8:16], offset+8); err != nil {
+			return nil, err
+		}
+		header.size = int64(binary.BigEndian.Uint64(buf[8:16]))
+		header.headerSize = 16
+	}
+	if header.size < header.headerSize || offset+header.size > fileSize {
+		return nil, errFmp4Format
+	}
+	return header, nil
+}
+
+// childBoxes indexes the boxes directly inside a box payload
+func childBoxes(payload []byte) map[string][][]byte {
+	children := make(map[string][][]byte)
+	for len(payload) >= 8 {
+		size := int(binary.BigEndian.Uint32(payload))
+		if size < 8 || size > len(payload) {
+			break
+		}
+		boxType := string(payload[4:8])
+		children[boxType] = append(children[boxType], payload[8:size])
+		payload = payload[size:]
+	}
+	return children
+}
+
+func childBox(payload []byte, path ...string) []byte {
+	for _, boxType := range path {
+		boxes := childBoxes(payload)[boxType]
+		if len(boxes) == 0 {
+			return nil
+		}
+		payload = boxes[0]
+	}
+	return payload
+}
+
+type fmp4Track struct {
+	track           *remuxTrack
+	trackId         uint32
+	defaultDuration uint32
+	defaultSize     uint32
+	defaultFlags    uint32
+	nextDts         int64
+	// a track continued by a later init segment, such as the next DASH period, shifts its restarted timeline
+	// to where the previous part ended
+	rebase   bool
+	dtsShift int64
+}
+
+// demuxFmp4 copies the first video or audio track of a fragmented MP4 file into m
+func demuxFmp4(fileName string, m *remuxer) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var track *fmp4Track
+	for offset := int64(0); offset < info.Size(); {
+		header, err := readBoxHeader(file, offset, info.Size())
+		if err != nil {
+			return err
+		}
+		offset += header.size
+		if header.boxType != "moov" && header.boxType != "moof" {
+			continue
+		}
+		payload := make([]byte, header.size-header.headerSize)
+		if _, err = file.ReadAt(payload, header.offset+header.headerSize); err != nil {
+			return err
+		}
+		if header.boxType == "moov" {
+			if track == nil {
+				if track, err = parseFmp4Moov(payload, m, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			// the file goes on with another init segment of the same track
+			next, err := parseFmp4Moov(payload, m, track.track)
+			if err != nil {
+				return err
+			}
+			next.nextDts, next.rebase = track.nextDts, true
+			track = next
+			continue
+		}
+		if track == nil {
+			return errFmp4Format
+		}
+		if err = track.readFragment(file, payload, header.offset, m); err != nil {
+			return err
+		}
+	}
+	if track == nil || len(track.track.samples) == 0 {
+		return errFmp4Format
+	}
+
+	// signed composition offsets are shifted so every sample has a non negative offset, the edit list absorbs the shift
+	minCts := int64(0)
+	for _, sample := range track.track.samples {
+		minCts = min(minCts, sample.cts)
+	}
+	for i := range track.track.samples {
+		track.track.samples[i].cts -= minCts
+	}
+	return nil
+}
+
+// parseFmp4Moov finds the track a fragmented MP4 provides, a track kind another input already provided is skipped,
+// while continued names the track a repeated moov has to describe
+func parseFmp4Moov(moov []byte, m *remuxer, continued *remuxTrack) (*fmp4Track, error) {
+	children := childBoxes(moov)
+	for _, trak := range children["trak"] {
+		hdlr := childBox(trak, "mdia", "hdlr")
+		mdhd := childBox(trak, "mdia", "mdhd")
+		tkhd := childBox(trak, "tkhd")
+		stsd := childBox(trak, "mdia", "minf", "stbl", "stsd")
+		if len(hdlr) < 12 || len(mdhd) < 24 || len(tkhd) < 20 || len(stsd) < 16 {
+			continue
+		}
+		var target *remuxTrack
+		switch string(hdlr[8:12]) {
+		case "vide":
+			target = m.videoTrack()
+		case "soun":
+			target = m.audioTrack()
+		default:
+			continue
+		}
+		if continued != nil && target != continued {
+			continue
+		}
+		if continued == nil && len(target.samples) > 0 {
+			// the other input already provided this kind of track
+			continue
+		}
+
+		timescaleOffset, trackIdOffset, sizeOffset := 12, 12, 76
+		if mdhd[0] == 1 {
+			timescaleOffset = 20
+		}
+		if tkhd[0] == 1 {
+			trackIdOffset, sizeOffset = 20, 88
+		}
+		timescale := binary.BigEndian.Uint32(mdhd[timescaleOffset:])
+		if continued != nil {
+			// the samples so far are in the timescale of the first init segment, their description is kept too
+			if timescale != target.timescale {
+				return nil, errFmp4Format
+			}
+		} else {
+			target.timescale = timescale
+			if len(tkhd) >= sizeOffset+8 {
+				target.width = int(binary.BigEndian.Uint32(tkhd[sizeOffset:]) >> 16)
+				target.height = int(binary.BigEndian.Uint32(tkhd[sizeOffset+4:]) >> 16)
+			}
+			entrySize := int(binary.BigEndian.Uint32(stsd[8:]))
+			if entrySize < 8 || 8+entrySize > len(stsd) {
+				return nil, errFmp4Format
+			}
+			target.sampleEntry = append([]byte{}, stsd[8:8+entrySize]...)
+		}
+
+		track := &fmp4Track{
+			track:   target,
+			trackId: binary.BigEndian.Uint32(tkhd[trackIdOffset:]),
+		}
+		for _, trex := range childBoxes(childBox(moov, "mvex"))["trex"] {
+			if len(trex) >= 24 && binary.BigEndian.Uint32(trex[4:]) == track.trackId {
+				track.defaultDuration = binary.BigEndian.Uint32(trex[12:])
+				track.defaultSize = binary.BigEndian.Uint32(trex[16:])
+				track.defaultFlags = binary.BigEndian.Uint32(trex[20:])
+			}
+		}
+		return track, nil
+	}
+	return nil, errFmp4Format
+}
+
+// readFragment reads the samples a moof describes, data offsets are relative to the moof unless the fragment gives a base offset
+func (t *fmp4Track) readFragment(file io.ReaderAt, moof []byte, moofOffset int64, m *remuxer) error {
+	for _, traf := range childBoxes(moof)["traf"] {
+		children := childBoxes(traf)
+		tfhds := children["tfhd"]
+		if len(tfhds) == 0 || len(tfhds[0]) < 8 {
+			continue
+		}
+		tfhd := tfhds[0]
+		flags := binary.BigEndian.Uint32(tfhd) & 0xFFFFFF
+		if binary.BigEndian.Uint32(tfhd[4:]) != t.trackId {
+			continue
+		}
+		base := moofOffset
+		duration, size, sampleFlags := t.defaultDuration, t.defaultSize, t.defaultFlags
+		pos := 8
+		read32 := func() uint32 {
+			if pos+4 > len(tfhd) {
+				return 0
+			}
+			v := binary.BigEndian.Uint32(tfhd[pos:])
+			pos += 4
+			return v
+		}
+		if flags&0x01 != 0 {
+			base = int64(read32())<<32 | int64(read32())
+		}
+		if flags&0x02 != 0 {
+			read32()
+		}
+		if flags&0x08 != 0 {
+			duration = read32()
+		}
+		if flags&0x10 != 0 {
+			size = read32()
+		}
+		if flags&0x20 != 0 {
+			sampleFlags = read32()
+		}
+
+		if tfdt := children["tfdt"]; len(tfdt) > 0 && len(tfdt[0]) >= 8 {
+			var dts int64
+			if tfdt[0][0] == 1 && len(tfdt[0]) >= 12 {
+				dts = int64(binary.BigEndian.Uint64(tfdt[0][4:]))
+			} else {
+				dts = int64(binary.BigEndian.Uint32(tfdt[0][4:]))
+			}
+			if t.rebase {
+				t.dtsShift, t.rebase = t.nextDts-dts, false
+			}
+			t.nextDts = dts + t.dtsShift
+		}
+
+		dataPos := base
+		for _, trun := range children["trun"] {
+			if len(trun) < 8 {
+				continue
+			}
+			version := trun[0]
+			trunFlags := binary.BigEndian.Uint32(trun) & 0xFFFFFF
+			count := int(binary.BigEndian.Uint32(trun[4:]))
+			p := 8
+			if trunFlags&0x01 != 0 && p+4 <= len(trun) {
+				dataPos = base + int64(int32(binary.BigEndian.Uint32(trun[p:])))
+				p += 4
+			}
+			firstFlags, hasFirstFlags := uint32(0), false
+			if trunFlags&0x04 != 0 && p+4 <= len(trun) {
+				firstFlags, hasFirstFlags = binary.BigEndian.Uint32(trun[p:]), true
+				p += 4
+			}
+			for i := 0; i < count; i++ {
+				sampleDuration, sampleSize, flagsValue, cts := duration, size, sampleFlags, int64(0)
+				next := func() uint32 {
+					if p+4 > len(trun) {
+						return 0
+					}
+					v := binary.BigEndian.Uint32(trun[p:])
+					p += 4
+					return v
+				}
+				if trunFlags&0x100 != 0 {
+					sampleDuration = next()
+				}
+				if trunFlags&0x200 != 0 {
+					sampleSize = next()
+				}
+				if trunFlags&0x400 != 0 {
+					flagsValue = next()
+				}
+				if trunFlags&0x800 != 0 {
+					if version == 0 {
+						cts = int64(next())
+					} else {
+						cts = int64(int32(next()))
+					}
+				}
+				if i == 0 && hasFirstFlags {
+					flagsValue = firstFlags
+				}
+				data := make([]byte, sampleSize)
+				if _, err := file.ReadAt(data, dataPos); err != nil {
+					return err
+				}
+				key := !t.track.video || flagsValue&0x00010000 == 0
+				if err := m.writeSample(t.track, data, t.nextDts, cts, key); err != nil {
+					return err
+				}
+				dataPos += int64(sampleSize)
+				t.nextDts += int64(sampleDuration)
+			}
+		}
+	}
+	return nil
+}
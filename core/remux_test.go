@@ -0,0 +1,178 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testTsPackets splits a payload into the 188 byte packets of pid, the last one is padded with an adaptation field
+func testTsPackets(pid int, payload []byte) []byte {
+	var out []byte
+	for first := true; len(payload) > 0 || first; first = false {
+		packet := make([]byte, tsPacketSize)
+		packet[0] = 0x47
+		packet[1] = byte(pid >> 8)
+		if first {
+			packet[1] |= 0x40
+		}
+		packet[2] = byte(pid)
+		n := min(len(payload), 184)
+		if n < 184 {
+			packet[3] = 0x30
+			stuffing := 184 - n - 1
+			packet[4] = byte(stuffing)
+			if stuffing > 0 {
+				packet[5] = 0
+				for i := 6; i < 5+stuffing; i++ {
+					packet[i] = 0xFF
+				}
+			}
+			copy(packet[5+stuffing:], payload[:n])
+		} else {
+			packet[3] = 0x10
+			copy(packet[4:], payload[:n])
+		}
+		payload = payload[n:]
+		out = append(out, packet...)
+	}
+	return out
+}
+
+// testAdtsFrame is an AAC LC frame at 44.1 kHz stereo with a payload of size bytes
+func testAdtsFrame(size int) []byte {
+	frame := make([]byte, 7+size)
+	length := len(frame)
+	frame[0], frame[1], frame[2], frame[3] = 0xFF, 0xF1, 1<<6|4<<2, 2<<6|byte(length>>11)
+	frame[4], frame[5], frame[6] = byte(length>>3), byte(length<<5)|0x1F, 0xFC
+	return frame
+}
+
+func TestDemuxTsAudioGap(t *testing.T) {
+	pat := []byte{0, 0, 0xB0, 13, 0, 1, 0xC1, 0, 0, 0, 1, 0xE1, 0x00, 0, 0, 0, 0}
+	pmt := []byte{0, 2, 0xB0, 18, 0, 1, 0xC1, 0, 0, 0xE1, 0x02, 0xF0, 0, 0x0F, 0xE1, 0x02, 0xF0, 0, 0, 0, 0, 0}
+	stream := append(testTsPackets(0, pat), testTsPackets(0x100, pmt)...)
+
+	// two frames per packet, the stream skips ten packets after the third one
+	const framesPerPes = 2
+	var starts []int64
+	for i := 0; i < 6; i++ {
+		start := int64(i * framesPerPes * 1024)
+		if i >= 3 {
+			start += 10 * framesPerPes * 1024
+		}
+		starts = append(starts, start)
+		pts := start * 90000 / 44100
+		pes := []byte{0, 0, 1, 0xC0, 0, 0, 0x80, 0x80, 5,
+			0x21 | byte(pts>>29&0x0E), byte(pts >> 22), byte(pts>>14) | 1, byte(pts >> 7), byte(pts<<1) | 1}
+		pes = append(pes, bytes.Repeat(testAdtsFrame(20), framesPerPes)...)
+		stream = append(stream, testTsPackets(0x102, pes)...)
+	}
+
+	m, err := newRemuxer(filepath.Join(t.TempDir(), "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+	if err = demuxTs(bytes.NewReader(stream), m); err != nil {
+		t.Fatal(err)
+	}
+	if m.audio == nil || len(m.audio.samples) != len(starts)*framesPerPes {
+		t.Fatal("audio samples missing")
+	}
+	for i, sample := range m.audio.samples {
+		want := starts[i/framesPerPes] + int64(i%framesPerPes)*1024
+		// the 90 kHz timestamps round the sample position down by at most one
+		if sample.dts < want-1 || sample.dts > want {
+			t.Errorf("sample %d dts = %d, want %d", i, sample.dts, want)
+		}
+	}
+}
+
+// testFmp4Init is the init segment of a fragmented MP4 with one track of the given handler
+func testFmp4Init(handler string, timescale uint32, entry []byte) []byte {
+	tkhd := mp4FullBox("tkhd", 0, 3, be32(0), be32(0), be32(1), be32(0), be32(0), make([]byte, 8), make([]byte, 8), mp4Matrix(), be32(640<<16), be32(360<<16))
+	mdhd := mp4FullBox("mdhd", 0, 0, be32(0), be32(0), be32(timescale), be32(0), be32(0))
+	hdlr := mp4FullBox("hdlr", 0, 0, be32(0), []byte(handler), make([]byte, 12), []byte{0})
+	stsd := mp4FullBox("stsd", 0, 0, be32(1), entry)
+	trak := mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", mp4Box("stbl", stsd))))
+	trex := mp4FullBox("trex", 0, 0, be32(1), be32(1), be32(0), be32(0), be32(0))
+	return append(mp4Box("ftyp", []byte("iso6"), be32(0)), mp4Box("moov", trak, mp4Box("mvex", trex))...)
+}
+
+// testFmp4Fragment is a moof and mdat of track 1 with samples of the given sizes starting at dts
+func testFmp4Fragment(dts uint64, sizes []int, duration uint32) []byte {
+	build := func(offset uint32) []byte {
+		var entries []byte
+		for i, size := range sizes {
+			flags := uint32(0x00010000)
+			if i == 0 {
+				flags = 0
+			}
+			entries = append(entries, be32(duration)...)
+			entries = append(entries, be32(uint32(size))...)
+			entries = append(entries, be32(flags)...)
+		}
+		trun := mp4FullBox("trun", 0, 0x701, be32(uint32(len(sizes))), be32(offset), entries)
+		traf := mp4Box("traf", mp4FullBox("tfhd", 0, 0x020000, be32(1)), mp4FullBox("tfdt", 1, 0, be64(dts)), trun)
+		return mp4Box("moof", mp4FullBox("mfhd", 0, 0, be32(1)), traf)
+	}
+	moof := build(0)
+	moof = build(uint32(len(moof) + 8))
+	var data []byte
+	for i, size := range sizes {
+		data = append(data, bytes.Repeat([]byte{byte(i + 1)}, size)...)
+	}
+	return append(moof, mp4Box("mdat", data)...)
+}
+
+func TestMuxFragmentedTwoPeriods(t *testing.T) {
+	dir := t.TempDir()
+	videoEntry := mp4Box("avc1", make([]byte, 78), mp4Box("avcC", []byte{1, 0x64, 0, 0x1F, 0xFF, 0xE0, 0}))
+	audioEntry := mp4Box("mp4a", make([]byte, 28))
+	// every period starts its own timeline at zero after its own init segment
+	var video, audio []byte
+	for period := 0; period < 2; period++ {
+		video = append(video, testFmp4Init("vide", 1000, videoEntry)...)
+		video = append(video, testFmp4Fragment(0, []int{100, 50}, 1000)...)
+		audio = append(audio, testFmp4Init("soun", 48000, audioEntry)...)
+		audio = append(audio, testFmp4Fragment(0, []int{10, 10}, 48000)...)
+	}
+	videoFile, audioFile := filepath.Join(dir, "a.video.mp4"), filepath.Join(dir, "a.audio.mp4")
+	if err := os.WriteFile(videoFile, video, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(audioFile, audio, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := newRemuxer(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+	for _, fileName := range []string{videoFile, audioFile} {
+		if err = demuxFmp4(fileName, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, track := range []struct {
+		name  string
+		track *remuxTrack
+		step  int64
+	}{{"video", m.video, 1000}, {"audio", m.audio, 48000}} {
+		if track.track == nil || len(track.track.samples) != 4 {
+			t.Fatalf("%s samples missing", track.name)
+		}
+		for i, sample := range track.track.samples {
+			if sample.dts != int64(i)*track.step {
+				t.Errorf("%s sample %d dts = %d, want %d", track.name, i, sample.dts, int64(i)*track.step)
+			}
+		}
+	}
+
+	if err = MuxFragmented(filepath.Join(dir, "a.mp4"), videoFile, audioFile); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,232 @@
+package core
+
+import (
+	"io"
+)
+
+const tsPacketSize = 188
+
+const (
+	tsStreamH264 = 0x1B
+	tsStreamAac  = 0x0F
+)
+
+// tsTimestamp undoes the 33 bit wrap of MPEG-TS clocks
+type tsTimestamp struct {
+	last   int64
+	offset int64
+	set    bool
+}
+
+func (t *tsTimestamp) unwrap(v int64) int64 {
+	const wrap = int64(1) << 33
+	if t.set {
+		if v+t.offset < t.last-wrap/2 {
+			t.offset += wrap
+		} else if v+t.offset > t.last+wrap/2 && t.offset >= wrap {
+			t.offset -= wrap
+		}
+	}
+	t.set = true
+	t.last = v + t.offset
+	return t.last
+}
+
+type tsDemuxer struct {
+	m        *remuxer
+	pmtPid   int
+	streams  map[int]byte
+	buffers  map[int][]byte
+	clock    tsTimestamp
+	audioDts int64
+}
+
+// demuxTs reads the H.264 and AAC elementary streams of the first program in a transport stream
+func demuxTs(reader io.Reader, m *remuxer) error {
+	d := &tsDemuxer{
+		m:       m,
+		pmtPid:  -1,
+		streams: make(map[int]byte),
+		buffers: make(map[int][]byte),
+	}
+	packet := make([]byte, tsPacketSize)
+	for {
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		if packet[0] != 0x47 {
+			return errRemuxFormat
+		}
+		if err := d.packet(packet); err != nil {
+			return err
+		}
+	}
+	for pid := range d.buffers {
+		if err := d.flush(pid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *tsDemuxer) packet(packet []byte) error {
+	start := packet[1]&0x40 != 0
+	pid := int(packet[1]&0x1F)<<8 | int(packet[2])
+	adaptation := packet[3] >> 4 & 0x03
+	offset := 4
+	if adaptation&0x02 != 0 {
+		offset += 1 + int(packet[4])
+	}
+	if adaptation&0x01 == 0 || offset >= tsPacketSize {
+		return nil
+	}
+	payload := packet[offset:]
+
+	switch {
+	case pid == 0:
+		if start {
+			d.parsePat(payload)
+		}
+	case pid == d.pmtPid:
+		if start {
+			d.parsePmt(payload)
+		}
+	case d.streams[pid] != 0:
+		if start {
+			if err := d.flush(pid); err != nil {
+				return err
+			}
+		}
+		if start || d.buffers[pid] != nil {
+			d.buffers[pid] = append(d.buffers[pid], payload...)
+		}
+	}
+	return nil
+}
+
+// psiSection skips the pointer field and returns the section bounded by its length
+func psiSection(payload []byte) []byte {
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil
+	}
+	section := payload[1+pointer:]
+	length := int(section[1]&0x0F)<<8 | int(section[2])
+	if 3+length > len(section) || length < 4 {
+		return nil
+	}
+	// drop the CRC
+	return section[:3+length-4]
+}
+
+func (d *tsDemuxer) parsePat(payload []byte) {
+	section := psiSection(payload)
+	for i := 8; i+4 <= len(section); i += 4 {
+		program := int(section[i])<<8 | int(section[i+1])
+		if program != 0 {
+			d.pmtPid = int(section[i+2]&0x1F)<<8 | int(section[i+3])
+			return
+		}
+	}
+}
+
+func (d *tsDemuxer) parsePmt(payload []byte) {
+	section := psiSection(payload)
+	if len(section) < 12 {
+		return
+	}
+	infoLength := int(section[10]&0x0F)<<8 | int(section[11])
+	for i := 12 + infoLength; i+5 <= len(section); {
+		streamType := section[i]
+		pid := int(section[i+1]&0x1F)<<8 | int(section[i+2])
+		esInfoLength := int(section[i+3]&0x0F)<<8 | int(section[i+4])
+		if streamType == tsStreamH264 || streamType == tsStreamAac {
+			d.streams[pid] = streamType
+		}
+		i += 5 + esInfoLength
+	}
+}
+
+func parsePesTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// flush hands a complete PES packet to the track of its stream
+func (d *tsDemuxer) flush(pid int) error {
+	pes := d.buffers[pid]
+	d.buffers[pid] = nil
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return nil
+	}
+	flags := pes[7] >> 6
+	headerEnd := 9 + int(pes[8])
+	if headerEnd > len(pes) {
+		return nil
+	}
+	pts, dts := int64(-1), int64(-1)
+	if flags&0x02 != 0 && len(pes) >= 14 {
+		pts = d.clock.unwrap(parsePesTimestamp(pes[9:14]))
+		dts = pts
+	}
+	if flags == 0x03 && len(pes) >= 19 {
+		dts = d.clock.unwrap(parsePesTimestamp(pes[14:19]))
+	}
+	data := pes[headerEnd:]
+
+	if d.streams[pid] == tsStreamH264 {
+		return d.video(data, pts, dts)
+	}
+	return d.audio(data, pts)
+}
+
+func (d *tsDemuxer) video(data []byte, pts, dts int64) error {
+	track := d.m.videoTrack()
+	sample, key := annexBToAvcc(track, data)
+	if len(sample) == 0 {
+		return nil
+	}
+	if dts < 0 {
+		if len(track.samples) == 0 {
+			return nil
+		}
+		// no timestamp, continue at the previous frame rate
+		last := track.samples[len(track.samples)-1]
+		dts = last.dts + int64(sampleDuration(track, len(track.samples)-1))
+		pts = dts + last.cts
+	}
+	return d.m.writeSample(track, sample, dts, max(0, pts-dts), key)
+}
+
+// audio splits a PES packet into ADTS frames, every AAC frame holds 1024 samples
+func (d *tsDemuxer) audio(data []byte, pts int64) error {
+	track := d.m.audioTrack()
+	for first := true; len(data) > 0; first = false {
+		header, err := parseAdts(data)
+		if err != nil || header.frameSize > len(data) {
+			return nil
+		}
+		if track.asc == nil {
+			track.asc = header.asc
+			track.sampleRate = header.sampleRate
+			track.channels = header.channels
+			track.timescale = uint32(header.sampleRate)
+		}
+		if first && pts >= 0 {
+			// frames follow each other without timestamps, the packet's own timestamp takes over
+			// after a gap or discontinuity so the audio does not drift away from the video
+			anchor := pts * int64(track.sampleRate) / 90000
+			if len(track.samples) == 0 || anchor-d.audioDts > 1024 || d.audioDts-anchor > 1024 {
+				d.audioDts = anchor
+			}
+		}
+		if err = d.m.writeSample(track, data[header.headerSize:header.frameSize], d.audioDts, 0, true); err != nil {
+			return err
+		}
+		d.audioDts += 1024
+		data = data[header.frameSize:]
+	}
+	return nil
+}
@@ -1,42 +1,72 @@
 package core
 
 import (
+	"context"
 	"encoding/base64"
 	"io"
 	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"sync"
-    "fmt"
+	"time"
 )
 
 const (
-	DownloadStatusReady   string = "ready" // task create but not start
-	DownloadStatusRunning string = "running"
-	DownloadStatusError   string = "error"
-	DownloadStatusDone    string = "done"
-	DownloadStatusHandle  string = "handle"
+	DownloadStatusReady     string = "ready" // task create but not start
+	DownloadStatusRunning   string = "running"
+	DownloadStatusError     string = "error"
+	DownloadStatusDone      string = "done"
+	DownloadStatusHandle    string = "handle"
+	DownloadStatusQueued    string = "queued"
+	DownloadStatusPaused    string = "paused"
+	DownloadStatusCancelled string = "cancelled"
 )
 
+// DownloadOptions are the per-download settings passed along with a MediaInfo
+type DownloadOptions struct {
+	DecodeStr  string `json:"decodeStr"`
+	SpeedLimit int    `json:"speedLimit"`
+	Priority   int    `json:"priority"`
+	Variant    string `json:"variant"`
+	Video      string `json:"video"`
+	Audio      string `json:"audio"`
+	Auto       bool   `json:"auto"`
+	SavePath   string `json:"-"`
+}
+
 type WxFileDecodeResult struct {
 	SavePath string
 	Message  string
 }
 
 type Resource struct {
-	mark      map[string]bool
-	markMu    sync.RWMutex
-	resType   map[string]bool
-	resTypeMu sync.RWMutex
+	mark        map[string]bool
+	groups      map[string]string
+	segments    map[string]int
+	headers     map[string]map[string]string
+	markMu      sync.RWMutex
+	resType     map[string]bool
+	resTypeMu   sync.RWMutex
+	journals    map[string]*DownloadJournal
+	journalsMu  sync.RWMutex
+	downloads   map[string]*downloadEntry
+	downloadsMu sync.Mutex
+	savePaths   map[string]bool
+	savePathsMu sync.Mutex
 }
 
 func initResource() *Resource {
 	if resourceOnce == nil {
 		resourceOnce = &Resource{
-			mark: make(map[string]bool),
+			mark:      make(map[string]bool),
+			groups:    make(map[string]string),
+			segments:  make(map[string]int),
+			headers:   make(map[string]map[string]string),
+			journals:  make(map[string]*DownloadJournal),
+			downloads: make(map[string]*downloadEntry),
+			savePaths: make(map[string]bool),
 			resType: map[string]bool{
 				"all":   true,
 				"image": true,
@@ -44,11 +74,13 @@ func initResource() *Resource {
 				"video": true,
 				"m3u8":  true,
 				"live":  true,
+				"mpd":   true,
 				"xls":   true,
 				"doc":   true,
 				"pdf":   true,
 			},
 		}
+		resourceOnce.restore()
 	}
 	return resourceOnce
 }
@@ -83,6 +115,7 @@ func (r *Resource) setResType(n []string) {
 		"video": false,
 		"m3u8":  false,
 		"live":  false,
+		"mpd":   false,
 		"xls":   false,
 		"doc":   false,
 		"pdf":   false,
@@ -93,120 +126,396 @@ func (r *Resource) setResType(n []string) {
 	}
 }
 
+// clear empties the capture list only, the library keeps its records until they are deleted,
+// the captured headers go and so do the cached bodies of resources the library does not keep
 func (r *Resource) clear() {
 	r.markMu.Lock()
-	defer r.markMu.Unlock()
 	r.mark = make(map[string]bool)
+	r.groups = make(map[string]string)
+	r.segments = make(map[string]int)
+	r.headers = make(map[string]map[string]string)
+	r.markMu.Unlock()
+
+	kept := make(map[string]bool)
+	for _, record := range libraryOnce.All() {
+		kept[record.UrlSign] = true
+	}
+	pruneCaptured(kept)
 }
 
 func (r *Resource) delete(sign string) {
 	r.markMu.Lock()
 	defer r.markMu.Unlock()
 	delete(r.mark, sign)
+	delete(r.headers, sign)
+	r.removeGroup(sign)
+	removeCaptured(sign)
+	libraryOnce.DeleteBySign(sign)
 }
 
-func (r *Resource) download(mediaInfo MediaInfo, decodeStr string) {
-	if globalConfig.SaveDirectory == "" {
-		return
+// capturedHeaders returns the request headers captured with a resource, they hold credentials
+// and are kept in memory only, so a resource restored from the library or a journal has none
+func (r *Resource) capturedHeaders(mediaInfo MediaInfo) map[string]string {
+	if mediaInfo.Headers != nil {
+		return mediaInfo.Headers
 	}
+	r.markMu.RLock()
+	defer r.markMu.RUnlock()
+	return r.headers[mediaInfo.UrlSign]
+}
 
+// replayHeaders returns the captured headers that may be sent along with a request to rawUrl
+func (r *Resource) replayHeaders(rawUrl string, mediaInfo MediaInfo) map[string]string {
+	return FilterHeaders(rawUrl, mediaInfo.Url, r.capturedHeaders(mediaInfo))
+}
 
-	go func(mediaInfo MediaInfo) {
-			// 添加 MediaInfo 详细信息打印
-		fmt.Printf("开始下载，MediaInfo详情:\n")
-
-		fmt.Printf("Description: %s\n", mediaInfo.Description)
-		rawUrl := mediaInfo.Url
-		fileName := Md5(rawUrl)
-		if mediaInfo.Description != "" {
-			// 1. 先移除 HTML 标签
-			description := regexp.MustCompile(`<[^>]*>`).ReplaceAllString(mediaInfo.Description, "")
-			// 2. 移除 HTML 实体字符
-			description = regexp.MustCompile(`&[^;]+;`).ReplaceAllString(description, "")
-			// 3. 移除话题标签（包括前中后位置的话题，支持无空格分隔）
-			description = regexp.MustCompile(`#[^#\s]+`).ReplaceAllString(description, "")
-			fmt.Printf("移除话题后: %s\n", description)
-			// 4. 移除多余空格（包括中间的空格）
-			description = regexp.MustCompile(`\s+`).ReplaceAllString(description, "")
-			// 5. 处理特殊字符和空格相关的问号
-			description = regexp.MustCompile(`([^\p{Han}\p{Latin}])[?？]|[?？]([^\p{Han}\p{Latin}])|(%20|\s)[?？]|[?？](%20|\s)`).ReplaceAllString(description, "$1$2")
-			// 5. 移除文件系统不支持的字符
-			fileName = regexp.MustCompile(`[<>:"/\\|*]`).ReplaceAllString(description, "")
-			// 6. 移除所有空格和转义空格
-			fileName = strings.ReplaceAll(fileName, "%20", "")
-			fileName = regexp.MustCompile(`\s+`).ReplaceAllString(fileName, "")
-			// 7. 移除末尾标点
-			fileName = strings.TrimRight(fileName, "！!。，,?？")
-			// 5. 移除多余的空格
-			fileName = strings.TrimSpace(fileName)
-			// 6. 处理问号：如果包含疑问词则保留问号
-			if strings.ContainsAny(fileName, "吗么呢") {
-				if strings.HasSuffix(fileName, "?") || strings.HasSuffix(fileName, "？") {
-					fileName = strings.TrimRight(fileName, "?？") + "?"
-				}
-			} else {
-				fileName = strings.TrimRight(fileName, "?？")
-			}
-			// 7. 移除其他末尾标点
-			fileName = strings.TrimRight(fileName, "！!。，,")
-			
-			fileLen := globalConfig.FilenameLen
-			if fileLen <= 0 {
-				fileLen = 10
-			}
-			
-			runes := []rune(fileName)
-			if len(runes) > fileLen {
-				fileName = string(runes[:fileLen])
-			}
+// restore marks the resources kept in the library as seen, so a restart does not list them again
+func (r *Resource) restore() {
+	r.markMu.Lock()
+	defer r.markMu.Unlock()
+	for _, record := range libraryOnce.All() {
+		r.mark[record.UrlSign] = true
+		if u, err := url.Parse(record.Url); err == nil {
+			r.newGroup(record.UrlSign, groupKey(u), record.Segments)
 		}
+	}
+}
 
-		if globalConfig.FilenameTime {
-			mediaInfo.SavePath = filepath.Join(globalConfig.SaveDirectory, fileName+"_"+GetCurrentDateTimeFormatted()+mediaInfo.Suffix)
-		} else {
-			mediaInfo.SavePath = filepath.Join(globalConfig.SaveDirectory, fileName+mediaInfo.Suffix)
+// loadJournals indexes the unfinished downloads left in the save directory by a previous run
+func (r *Resource) loadJournals() {
+	journals := ListJournals(globalConfig.SaveDirectory)
+	r.journalsMu.Lock()
+	defer r.journalsMu.Unlock()
+	for _, journal := range journals {
+		if journal.MediaInfo.Id != "" {
+			r.journals[journal.MediaInfo.Id] = journal
 		}
+	}
+	if len(journals) > 0 {
+		globalLogger.Info().Msgf("发现%d个未完成的下载", len(journals))
+	}
+}
 
-		if strings.Contains(rawUrl, "qq.com") {
-			if globalConfig.Quality == 1 &&
-				strings.Contains(rawUrl, "encfilekey=") &&
-				strings.Contains(rawUrl, "token=") {
-				parseUrl, err := url.Parse(rawUrl)
-				queryParams := parseUrl.Query()
-				if err == nil && queryParams.Has("encfilekey") && queryParams.Has("token") {
-					rawUrl = parseUrl.Scheme + "://" + parseUrl.Host + "/" + parseUrl.Path +
-						"?encfilekey=" + queryParams.Get("encfilekey") +
-						"&token=" + queryParams.Get("token")
-				}
-			} else if globalConfig.Quality > 1 && mediaInfo.OtherData["wx_file_formats"] != "" {
-				format := strings.Split(mediaInfo.OtherData["wx_file_formats"], "#")
-				qualityMap := []string{
-					format[0],
-					format[len(format)/2],
-					format[len(format)-1],
-				}
-				rawUrl += "&X-snsvideoflag=" + qualityMap[globalConfig.Quality-2]
-			}
+func (r *Resource) getJournal(id string) (*DownloadJournal, bool) {
+	r.journalsMu.RLock()
+	defer r.journalsMu.RUnlock()
+	journal, ok := r.journals[id]
+	return journal, ok
+}
+
+func (r *Resource) listJournals() []*DownloadJournal {
+	r.journalsMu.RLock()
+	defer r.journalsMu.RUnlock()
+	journals := make([]*DownloadJournal, 0, len(r.journals))
+	for _, journal := range r.journals {
+		journals = append(journals, journal)
+	}
+	return journals
+}
+
+// refreshJournal keeps the index in sync with the journal on disk after a download attempt
+func (r *Resource) refreshJournal(mediaInfo MediaInfo) {
+	r.journalsMu.Lock()
+	defer r.journalsMu.Unlock()
+	journal, err := LoadJournal(mediaInfo.SavePath)
+	if err != nil || journal.IsComplete() {
+		delete(r.journals, mediaInfo.Id)
+		return
+	}
+	r.journals[mediaInfo.Id] = journal
+}
+
+// download queues a download, it starts as soon as a slot is free
+func (r *Resource) download(mediaInfo MediaInfo, options DownloadOptions) {
+	if globalConfig.SaveDirectory == "" {
+		return
+	}
+	if options.Auto && globalConfig.SkipDownloaded {
+		if entry, ok := r.downloadedBefore(mediaInfo); ok {
+			mediaInfo.SavePath = entry.SavePath
+			mediaInfo.Hash = entry.Hash
+			r.progressEventsEmit(mediaInfo, "已下载过，已跳过", DownloadStatusDone)
+			return
+		}
+	}
+	if queueOnce.push(mediaInfo, options) {
+		r.progressEventsEmit(mediaInfo, "排队中", DownloadStatusQueued)
+	}
+	queueOnce.schedule()
+}
+
+// downloadedBefore looks the resource up in the download history, a captured body is matched by its content too
+func (r *Resource) downloadedBefore(mediaInfo MediaInfo) (*HistoryEntry, bool) {
+	if entry, ok := historyOnce.Lookup(mediaInfo); ok {
+		return entry, true
+	}
+	if cachePath, ok := CapturedFile(mediaInfo.UrlSign); ok && mediaInfo.DecodeKey == "" {
+		if hash, err := FileSha256(cachePath); err == nil {
+			return historyOnce.LookupHash(hash)
+		}
+	}
+	return nil, false
+}
+
+// run downloads a single resource and reports the outcome, it blocks until the download ends
+func (r *Resource) run(mediaInfo MediaInfo, options DownloadOptions) {
+	decodeStr := options.DecodeStr
+	rawUrl := mediaInfo.Url
+	if journal, ok := r.getJournal(mediaInfo.Id); ok {
+		rawUrl = journal.Url
+		mediaInfo.SavePath = journal.FileName
+		if decodeStr == "" {
+			decodeStr = journal.DecodeStr
 		}
+	} else if options.SavePath != "" {
+		// a paused download continues where it left off
+		mediaInfo.SavePath = options.SavePath
+		rawUrl = r.buildQualityUrl(mediaInfo)
+	} else {
+		savePath, exists := r.reserveSavePath(r.buildSavePath(mediaInfo))
+		defer r.releaseSavePath(savePath)
+		mediaInfo.SavePath = savePath
+		if exists {
+			mediaInfo.Hash, _ = FileSha256(savePath)
+			r.progressEventsEmit(mediaInfo, "文件已存在，已跳过", DownloadStatusDone)
+			return
+		}
+		rawUrl = r.buildQualityUrl(mediaInfo)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	limiter := NewRateLimiter(int64(options.SpeedLimit) * 1024)
+	if !r.register(mediaInfo, options, cancel, limiter) {
+		return
+	}
 
-		downloader := NewFileDownloader(rawUrl, mediaInfo.SavePath, globalConfig.TaskNumber)
-		downloader.progressCallback = func(totalDownloaded float64) {
-			r.progressEventsEmit(mediaInfo, strconv.Itoa(int(totalDownloaded))+"%", DownloadStatusRunning)
+	if mediaInfo.Classify == "live" {
+		r.runLive(ctx, mediaInfo, options, rawUrl, limiter)
+		return
+	}
+	if mediaInfo.Classify == "mpd" {
+		r.runDash(ctx, mediaInfo, options, rawUrl, limiter)
+		return
+	}
+	if mediaInfo.Classify == "m3u8" {
+		r.runHls(ctx, mediaInfo, options, rawUrl, limiter)
+		return
+	}
+
+	if cachePath, ok := CapturedFile(mediaInfo.UrlSign); ok {
+		r.unregister(mediaInfo.Id)
+		hash, _ := FileSha256(cachePath)
+		commitHash := hash
+		if decodeStr != "" {
+			// an existing file is never reused for content that is decrypted in place afterwards
+			commitHash = ""
 		}
-		err := downloader.Start()
+		savePath, err := materialize(cachePath, mediaInfo.SavePath, commitHash)
 		if err != nil {
 			r.progressEventsEmit(mediaInfo, err.Error())
 			return
 		}
-		if decodeStr != "" {
-			r.progressEventsEmit(mediaInfo, "解密中", DownloadStatusRunning)
-			if err := r.decodeWxFile(mediaInfo.SavePath, decodeStr); err != nil {
-				r.progressEventsEmit(mediaInfo, "解密出错"+err.Error())
-				return
+		mediaInfo.SavePath = savePath
+		mediaInfo.Hash = hash
+		r.finish(mediaInfo, decodeStr)
+		return
+	}
+
+	downloader := NewFileDownloader(rawUrl, mediaInfo.SavePath, globalConfig.TaskNumber)
+	downloader.ctx = ctx
+	downloader.Limiter = limiter
+	downloader.Headers = r.replayHeaders(rawUrl, mediaInfo)
+	downloader.MediaInfo = mediaInfo
+	downloader.DecodeStr = decodeStr
+	downloader.progressCallback = func(progress DownloadProgress) {
+		r.progressDetailEmit(mediaInfo, progress)
+	}
+	err := downloader.Start()
+	r.refreshJournal(mediaInfo)
+	if err != nil {
+		r.stopped(mediaInfo, err)
+		return
+	}
+	mediaInfo.SavePath = downloader.FileName
+	r.unregister(mediaInfo.Id)
+	mediaInfo.Hash = downloader.Sha256
+	r.finish(mediaInfo, decodeStr)
+}
+
+// runHls downloads the segments of a m3u8 playlist and joins them into one file
+func (r *Resource) runHls(ctx context.Context, mediaInfo MediaInfo, options DownloadOptions, rawUrl string, limiter *RateLimiter) {
+	downloader := NewHlsDownloader(rawUrl, mediaInfo.SavePath)
+	downloader.ctx = ctx
+	downloader.Variant = options.Variant
+	downloader.Limiter = limiter
+	downloader.Headers = r.capturedHeaders(mediaInfo)
+	downloader.CapturedUrl = mediaInfo.Url
+	downloader.progressCallback = func(progress DownloadProgress) {
+		r.progressDetailEmit(mediaInfo, progress)
+	}
+	err := downloader.Start()
+	if err == errHlsLive {
+		// a playlist without an end tag is still being written, record it instead
+		r.runLive(ctx, mediaInfo, options, rawUrl, limiter)
+		return
+	}
+	mediaInfo.SavePath = downloader.FileName
+	if err != nil {
+		r.stopped(mediaInfo, err)
+		return
+	}
+	r.unregister(mediaInfo.Id)
+	mediaInfo.Hash = downloader.Sha256
+	if filepath.Ext(mediaInfo.SavePath) == ".ts" {
+		mediaInfo = r.remux(mediaInfo)
+	}
+	r.finish(mediaInfo, "")
+}
+
+// runDash downloads the chosen representations of a MPD and muxes them into one file
+func (r *Resource) runDash(ctx context.Context, mediaInfo MediaInfo, options DownloadOptions, rawUrl string, limiter *RateLimiter) {
+	downloader := NewDashDownloader(rawUrl, mediaInfo.SavePath)
+	downloader.ctx = ctx
+	downloader.Video = options.Video
+	downloader.Audio = options.Audio
+	downloader.Limiter = limiter
+	downloader.Headers = r.capturedHeaders(mediaInfo)
+	downloader.CapturedUrl = mediaInfo.Url
+	downloader.progressCallback = func(progress DownloadProgress) {
+		r.progressDetailEmit(mediaInfo, progress)
+	}
+	err := downloader.Start()
+	mediaInfo.SavePath = downloader.FileName
+	if err != nil {
+		r.stopped(mediaInfo, err)
+		return
+	}
+	r.unregister(mediaInfo.Id)
+	mediaInfo.Hash = downloader.Sha256
+	r.finish(mediaInfo, "")
+}
+
+// runLive records a live stream until it ends, is stopped or reaches the configured limits
+func (r *Resource) runLive(ctx context.Context, mediaInfo MediaInfo, options DownloadOptions, rawUrl string, limiter *RateLimiter) {
+	recorder := NewLiveRecorder(rawUrl, mediaInfo.SavePath)
+	recorder.ctx = ctx
+	recorder.Variant = options.Variant
+	recorder.Limiter = limiter
+	recorder.Headers = r.capturedHeaders(mediaInfo)
+	recorder.CapturedUrl = mediaInfo.Url
+	recorder.MaxDuration = time.Duration(globalConfig.LiveMaxDuration) * time.Minute
+	recorder.MaxSize = int64(globalConfig.LiveMaxSize) * 1048576
+	recorder.SplitDuration = time.Duration(globalConfig.LiveSplitDuration) * time.Minute
+	recorder.progressCallback = func(progress DownloadProgress) {
+		r.progressDetailEmit(mediaInfo, progress)
+	}
+	var reserved []string
+	recorder.reservePath = func(path string) string {
+		path = r.reserveFreePath(path)
+		reserved = append(reserved, path)
+		return path
+	}
+	defer func() {
+		for _, path := range reserved {
+			r.releaseSavePath(path)
+		}
+	}()
+	err := recorder.Start()
+	if len(recorder.Files) > 0 {
+		mediaInfo.SavePath = recorder.Files[0]
+	}
+	if err != nil {
+		if entry, ok := r.getDownload(mediaInfo.Id); ok && err == errDownloadCancelled && entry.deleteFile {
+			for _, fileName := range recorder.Files {
+				_ = os.Remove(fileName)
 			}
 		}
-		r.progressEventsEmit(mediaInfo, "完成", DownloadStatusDone)
-	}(mediaInfo)
+		r.stopped(mediaInfo, err)
+		return
+	}
+	r.unregister(mediaInfo.Id)
+
+	files := make([]string, 0, len(recorder.Files))
+	for _, fileName := range recorder.Files {
+		item := mediaInfo
+		item.SavePath = fileName
+		if ext := filepath.Ext(fileName); ext == ".ts" || ext == ".flv" {
+			item = r.remux(item)
+		}
+		files = append(files, item.SavePath)
+	}
+	if len(files) == 0 {
+		r.progressEventsEmit(mediaInfo, "未录制到数据")
+		return
+	}
+	mediaInfo.SavePath = files[0]
+	mediaInfo.Hash, _ = FileSha256(files[0])
+	r.finish(mediaInfo, "")
+}
+
+// remux converts a finished capture to MP4, the original file is kept when that fails
+func (r *Resource) remux(mediaInfo MediaInfo) MediaInfo {
+	r.progressEventsEmit(mediaInfo, "转换中", DownloadStatusRunning)
+	savePath := RemuxPath(mediaInfo.SavePath)
+	if err := RemuxFile(mediaInfo.SavePath, savePath); err != nil {
+		globalLogger.Esg(err, "remux %s failed", mediaInfo.SavePath)
+		return mediaInfo
+	}
+	_ = os.Remove(mediaInfo.SavePath)
+	mediaInfo.SavePath = savePath
+	mediaInfo.Hash, _ = FileSha256(savePath)
+	return mediaInfo
+}
+
+// stopped reports a download that ended without finishing
+func (r *Resource) stopped(mediaInfo MediaInfo, err error) {
+	switch err {
+	case errDownloadPaused:
+		r.setDownloadStatus(mediaInfo, DownloadStatusPaused)
+		r.progressEventsEmit(mediaInfo, "已暂停", DownloadStatusPaused)
+	case errDownloadCancelled:
+		entry, _ := r.getDownload(mediaInfo.Id)
+		r.unregister(mediaInfo.Id)
+		r.discard(mediaInfo, entry != nil && entry.deleteFile)
+		r.progressEventsEmit(mediaInfo, "已取消", DownloadStatusCancelled)
+	default:
+		r.unregister(mediaInfo.Id)
+		r.progressEventsEmit(mediaInfo, err.Error())
+	}
+}
+
+// finish decrypts the saved file when needed and reports the download as done
+func (r *Resource) finish(mediaInfo MediaInfo, decodeStr string) {
+	if decodeStr != "" {
+		r.progressEventsEmit(mediaInfo, "解密中", DownloadStatusRunning)
+		if err := r.decodeWxFile(mediaInfo.SavePath, decodeStr); err != nil {
+			r.progressEventsEmit(mediaInfo, "解密出错"+err.Error())
+			return
+		}
+		if hash, err := FileSha256(mediaInfo.SavePath); err == nil {
+			mediaInfo.Hash = hash
+			// only the decrypted content can match an earlier copy
+			mediaInfo.SavePath = dropDuplicate(mediaInfo.SavePath, hash)
+		}
+	}
+	r.progressEventsEmit(mediaInfo, "完成", DownloadStatusDone)
+}
+
+// buildSavePath renders the file name template, directories the template names are created on the way
+func (r *Resource) buildSavePath(mediaInfo MediaInfo) string {
+	savePath := filepath.Join(globalConfig.SaveDirectory, filepath.FromSlash(RenderFilename(filenameTemplate(), mediaInfo, time.Now())))
+	if err := CreateDirIfNotExist(filepath.Dir(savePath)); err != nil {
+		globalLogger.Esg(err, "create save directory err")
+	}
+	return savePath
+}
+
+func (r *Resource) buildQualityUrl(mediaInfo MediaInfo) string {
+	if site := matchSiteUrl(mediaInfo.Url); site != nil {
+		return site.DownloadUrl(mediaInfo)
+	}
+	return mediaInfo.Url
 }
 
 func (r *Resource) wxFileDecode(mediaInfo MediaInfo, fileName, decodeStr string) (string, error) {
@@ -245,15 +554,38 @@ func (r *Resource) progressEventsEmit(mediaInfo MediaInfo, args ...string) {
 		Status = args[1]
 	}
 
+	libraryOnce.SetStatus(mediaInfo.Id, Status, mediaInfo.SavePath, mediaInfo.Hash)
+	if Status == DownloadStatusDone {
+		historyOnce.Record(mediaInfo)
+	}
 	httpServerOnce.send("downloadProgress", map[string]interface{}{
 		"Id":       mediaInfo.Id,
 		"Status":   Status,
 		"SavePath": mediaInfo.SavePath,
+		"Hash":     mediaInfo.Hash,
 		"Message":  Message,
 	})
 	return
 }
 
+// progressDetailEmit reports a running download with byte counts, speed and ETA
+func (r *Resource) progressDetailEmit(mediaInfo MediaInfo, progress DownloadProgress) {
+	httpServerOnce.send("downloadProgress", map[string]interface{}{
+		"Id":         mediaInfo.Id,
+		"Status":     DownloadStatusRunning,
+		"SavePath":   mediaInfo.SavePath,
+		"Hash":       mediaInfo.Hash,
+		"Message":    strconv.Itoa(int(progress.Percent)) + "%",
+		"Downloaded": progress.Downloaded,
+		"Total":      progress.Total,
+		"Percent":    progress.Percent,
+		"Speed":      progress.Speed,
+		"Eta":        progress.Eta,
+		"Chunks":     progress.Chunks,
+		"Duration":   progress.Duration,
+	})
+}
+
 func (r *Resource) decodeWxFile(fileName, decodeStr string) error {
 	decodedBytes, err := base64.StdEncoding.DecodeString(decodeStr)
 	if err != nil {
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// PartSuffix marks a file that is still being written, it is renamed to the target once complete
+const PartSuffix = ".part"
+
+// What happens when the file a download is saved to already exists
+const (
+	ConflictRename       = "rename"
+	ConflictSkip         = "skip"
+	ConflictOverwrite    = "overwrite"
+	ConflictSkipSameHash = "skipSameHash"
+)
+
+var numberedPattern = regexp.MustCompile(` \((\d+)\)$`)
+
+func conflictPolicy() string {
+	switch globalConfig.FileConflict {
+	case ConflictSkip, ConflictOverwrite, ConflictSkipSameHash:
+		return globalConfig.FileConflict
+	}
+	return ConflictRename
+}
+
+// numberedPath returns path for n 1 and "name (n).ext" after that
+func numberedPath(path string, n int) string {
+	if n <= 1 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// unnumberedPath strips the number numberedPath added
+func unnumberedPath(path string) string {
+	ext := filepath.Ext(path)
+	return numberedPattern.ReplaceAllString(strings.TrimSuffix(path, ext), "") + ext
+}
+
+func freePath(path string, taken func(string) bool) string {
+	for n := 1; ; n++ {
+		if candidate := numberedPath(path, n); !taken(candidate) {
+			return candidate
+		}
+	}
+}
+
+// availablePath numbers path when a file already has its name, unless existing files are to be overwritten
+func availablePath(path string) string {
+	if conflictPolicy() == ConflictOverwrite {
+		return path
+	}
+	return freePath(path, FileExist)
+}
+
+// reserveSavePath claims a save path for a new download so concurrent downloads never share a file,
+// it reports true when the policy is to skip and the file already exists
+func (r *Resource) reserveSavePath(path string) (string, bool) {
+	r.savePathsMu.Lock()
+	defer r.savePathsMu.Unlock()
+	if conflictPolicy() == ConflictSkip && FileExist(path) {
+		return path, true
+	}
+	return r.claimPath(path), false
+}
+
+// reserveFreePath claims a path for a file a download adds next to its save path, such as the split files
+// of a recording, it is numbered rather than skipped when taken and only overwrites a file when that is the policy
+func (r *Resource) reserveFreePath(path string) string {
+	r.savePathsMu.Lock()
+	defer r.savePathsMu.Unlock()
+	return r.claimPath(path)
+}
+
+// claimPath numbers path until no download or file has it and marks it taken, the caller holds savePathsMu
+func (r *Resource) claimPath(path string) string {
+	policy := conflictPolicy()
+	path = freePath(path, func(candidate string) bool {
+		if r.savePaths[candidate] {
+			return true
+		}
+		if policy == ConflictOverwrite {
+			return false
+		}
+		return FileExist(candidate) || FileExist(candidate+PartSuffix) || FileExist(journalPath(candidate))
+	})
+	r.savePaths[path] = true
+	return path
+}
+
+func (r *Resource) releaseSavePath(path string) {
+	r.savePathsMu.Lock()
+	defer r.savePathsMu.Unlock()
+	delete(r.savePaths, path)
+}
+
+// sameFile looks for an earlier copy of target, numbered or not, with the given SHA-256, except is never matched
+func sameFile(target, sha256, except string) (string, bool) {
+	if sha256 == "" {
+		return "", false
+	}
+	base := unnumberedPath(target)
+	for n := 1; ; n++ {
+		candidate := numberedPath(base, n)
+		if !FileExist(candidate) {
+			return "", false
+		}
+		if candidate == except {
+			continue
+		}
+		if hash, err := FileSha256(candidate); err == nil && hash == sha256 {
+			return candidate, true
+		}
+	}
+}
+
+// commitPart renames the finished part file to target and returns where the content ended up,
+// an existing file with the same content is kept instead when the policy asks for it,
+// an empty sha256 leaves the comparison to the caller, a file that is decrypted afterwards is compared by dropDuplicate
+func commitPart(target, sha256 string) (string, error) {
+	part := target + PartSuffix
+	switch conflictPolicy() {
+	case ConflictOverwrite:
+	case ConflictSkipSameHash:
+		if existing, ok := sameFile(target, sha256, ""); ok {
+			return existing, os.Remove(part)
+		}
+		fallthrough
+	default:
+		// the target appeared while downloading, the finished file must not replace it
+		target = freePath(target, FileExist)
+	}
+	return target, os.Rename(part, target)
+}
+
+// dropDuplicate removes a newly saved file when the policy keeps an earlier copy with the same content
+// and returns where the content is
+func dropDuplicate(path, sha256 string) string {
+	if conflictPolicy() != ConflictSkipSameHash {
+		return path
+	}
+	existing, ok := sameFile(path, sha256, path)
+	if !ok {
+		return path
+	}
+	if err := os.Remove(path); err != nil {
+		return path
+	}
+	return existing
+}
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"github.com/elazarl/goproxy"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	"net/http"
+	"net/url"
+)
+
+// SiteHandler adds support for a site whose resources the generic detection cannot find on its own
+type SiteHandler interface {
+	// Name is the key that enables or disables the handler in Config.SiteHandlers
+	Name() string
+	// Title is shown in the settings
+	Title() string
+	// Match reports whether the handler is responsible for a host and path
+	Match(host, path string) bool
+	// RewriteRequest may answer a request itself, a nil response lets it go on to the site
+	RewriteRequest(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response)
+	// RewriteResponse may change a response, handled skips the generic resource detection
+	RewriteResponse(resp *http.Response) (*http.Response, bool)
+	// ExtractMedia finds the resources described by a JSON or HTML document of the site
+	ExtractMedia(contentType string, body []byte) ([]MediaInfo, error)
+	// DownloadUrl returns the url a resource is downloaded from, such as the variant of the configured quality
+	DownloadUrl(mediaInfo MediaInfo) string
+}
+
+// SiteInfo describes a handler for the settings
+type SiteInfo struct {
+	Name    string `json:"Name"`
+	Title   string `json:"Title"`
+	Enabled bool   `json:"Enabled"`
+}
+
+// siteHandlers are tried in order, the first enabled one that matches handles the traffic
+var siteHandlers = []SiteHandler{
+	&wechatHandler{},
+}
+
+// siteEnabled reports whether a handler is on, handlers missing from the config are
+func siteEnabled(name string) bool {
+	enabled, ok := globalConfig.SiteHandlers[name]
+	return !ok || enabled
+}
+
+func matchSite(host, path string) SiteHandler {
+	host = stripPort(host)
+	for _, site := range siteHandlers {
+		if siteEnabled(site.Name()) && site.Match(host, path) {
+			return site
+		}
+	}
+	return nil
+}
+
+// matchSiteUrl finds the handler of a resource url
+func matchSiteUrl(rawUrl string) SiteHandler {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil
+	}
+	return matchSite(u.Host, u.Path)
+}
+
+func siteInfos() []SiteInfo {
+	list := make([]SiteInfo, 0, len(siteHandlers))
+	for _, site := range siteHandlers {
+		list = append(list, SiteInfo{Name: site.Name(), Title: site.Title(), Enabled: siteEnabled(site.Name())})
+	}
+	return list
+}
+
+// collectSiteMedia lists the resources a handler extracts from a document, the handler fills in UrlSign when
+// the url alone does not identify the resource
+func collectSiteMedia(site SiteHandler, contentType string, body []byte) {
+	list, err := site.ExtractMedia(contentType, body)
+	if err != nil || len(list) == 0 {
+		return
+	}
+	resourceOnce.markMu.Lock()
+	defer resourceOnce.markMu.Unlock()
+	for _, res := range list {
+		if res.UrlSign == "" {
+			res.UrlSign = Md5(res.Url)
+		}
+		if _, ok := resourceOnce.mark[res.UrlSign]; ok {
+			continue
+		}
+		if res.Id == "" {
+			id, err := gonanoid.New()
+			if err != nil {
+				id = res.UrlSign
+			}
+			res.Id = id
+		}
+		if res.Status == "" {
+			res.Status = DownloadStatusReady
+		}
+		if res.OtherData == nil {
+			res.OtherData = map[string]string{}
+		}
+		resourceOnce.mark[res.UrlSign] = true
+		historyOnce.flag(&res)
+		libraryOnce.Add(res)
+		httpServerOnce.send("newResources", res)
+	}
+}
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is how much of a body is peeked at, enough for three TS packets
+const sniffLen = 512
+
+// sniffSkipTypes are the page types, they are never peeked at so pages and scripts pass through untouched
+var sniffSkipTypes = map[string]bool{
+	"text/html":                true,
+	"application/xhtml+xml":    true,
+	"text/css":                 true,
+	"text/javascript":          true,
+	"application/javascript":   true,
+	"application/x-javascript": true,
+	"application/json":         true,
+}
+
+// MediaType returns the lower case MIME type of a Content-Type value without its parameters
+func MediaType(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	return strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+}
+
+// SniffContentType recognizes media by the signature at the start of data, an empty result means unknown
+func SniffContentType(data []byte) string {
+	switch {
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		switch string(data[8:12]) {
+		case "M4A ", "M4B ", "M4P ":
+			return "audio/mp4"
+		case "qt  ":
+			return "video/quicktime"
+		case "3gp4", "3gp5", "3gp6", "3g2a":
+			return "video/3gpp"
+		case "heic", "heix", "mif1", "msf1":
+			return "image/heic"
+		case "avif", "avis":
+			return "image/avif"
+		}
+		return "video/mp4"
+	case len(data) >= 8 && (string(data[4:8]) == "styp" || string(data[4:8]) == "moof"):
+		return "video/iso.segment"
+	case bytes.HasPrefix(data, []byte("ID3")):
+		return "audio/mpeg"
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(data, []byte("OggS")):
+		if bytes.Contains(data, []byte("theora")) {
+			return "video/ogg"
+		}
+		return "audio/ogg"
+	case bytes.HasPrefix(data, []byte("%PDF-")):
+		return "application/pdf"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return "image/jpeg"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "image/gif"
+	case len(data) >= 12 && string(data[:4]) == "RIFF":
+		switch string(data[8:12]) {
+		case "WEBP":
+			return "image/webp"
+		case "WAVE":
+			return "audio/wav"
+		case "AVI ":
+			return "video/x-msvideo"
+		}
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		if bytes.Contains(data, []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case bytes.HasPrefix(data, []byte("FLV\x01")):
+		return "video/x-flv"
+	case len(data) >= 189 && data[0] == 0x47 && data[188] == 0x47 && (len(data) < 377 || data[376] == 0x47):
+		return "video/mp2t"
+	case bytes.HasPrefix(bytes.TrimLeft(data, "\xef\xbb\xbf \t\r\n"), []byte("#EXTM3U")):
+		return "application/vnd.apple.mpegurl"
+	case bytes.Contains(data, []byte("<MPD")):
+		return "application/dash+xml"
+	}
+	return ""
+}
+
+// peekBody reads what a single read of the body returns, at most n bytes, and puts it back,
+// so the client still receives the whole stream and a slow one is not held up
+func peekBody(resp *http.Response, n int) []byte {
+	head := make([]byte, n)
+	read, _ := resp.Body.Read(head)
+	head = head[:read]
+	prependBody(resp, head)
+	return head
+}
+
+// prependBody puts data read from the body back in front of the rest
+func prependBody(resp *http.Response, data []byte) {
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+}
+
+// sniffResponse peeks at a response that starts at the beginning of its body and returns the MIME type of its content
+func sniffResponse(resp *http.Response) string {
+	if resp.Body == nil || resp.Body == http.NoBody || resp.ContentLength == 0 || resp.Request.Method == http.MethodHead {
+		return ""
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return ""
+	}
+	if sniffSkipTypes[MediaType(resp.Header.Get("Content-Type"))] {
+		return ""
+	}
+	if resp.StatusCode == http.StatusPartialContent && !strings.HasPrefix(resp.Header.Get("Content-Range"), "bytes 0-") {
+		return ""
+	}
+	return SniffContentType(peekBody(resp, sniffLen))
+}
+
+// ResponseContentType decides the type of a response, a recognized signature wins over a header that disagrees with it
+func ResponseContentType(resp *http.Response) string {
+	contentType := resp.Header.Get("Content-Type")
+	sniffed := sniffResponse(resp)
+	if sniffed == "" || sniffAgrees(contentType, sniffed) {
+		return contentType
+	}
+	return sniffed
+}
+
+// sniffAgrees reports whether the header type fits the sniffed content, it is then kept as the more specific one
+func sniffAgrees(contentType, sniffed string) bool {
+	classify, _ := TypeSuffix(contentType)
+	sniffedClassify, _ := TypeSuffix(sniffed)
+	if classify == "" || sniffedClassify == "" {
+		return false
+	}
+	if classify == sniffedClassify {
+		return true
+	}
+	// these containers may hold audio only
+	switch sniffed {
+	case "video/mp4", "video/iso.segment", "video/webm", "video/x-matroska", "video/ogg":
+		return classify == "audio"
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
 )
@@ -18,18 +19,18 @@ func initSystem() *SystemSetup {
 	return systemOnce
 }
 
+// initCert writes the root certificate of this installation where the installers pick it up
 func (s *SystemSetup) initCert() ([]byte, error) {
+	publicCrt, _ := appOnce.ca()
 	content, err := os.ReadFile(s.CertFile)
-	if err == nil {
+	if err == nil && bytes.Equal(content, publicCrt) {
 		return content, nil
 	}
-	if os.IsNotExist(err) {
-		err = os.WriteFile(s.CertFile, appOnce.PublicCrt, 0777)
-		if err != nil {
-			return nil, err
-		}
-		return appOnce.PublicCrt, nil
-	} else {
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err = os.WriteFile(s.CertFile, publicCrt, 0644); err != nil {
 		return nil, err
 	}
+	return publicCrt, nil
 }
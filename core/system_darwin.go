@@ -120,5 +120,12 @@ func (s *SystemSetup) installCert() (string, error) {
 	if err != nil {
 		return string(output), err
 	}
+
+	// root certificates this app trusted before are removed, deleting one that is not installed fails harmlessly
+	for _, fingerprint := range appOnce.retiredCas() {
+		cmd = exec.Command("sudo", "-S", "security", "delete-certificate", "-Z", fingerprint, "-t", "/Library/Keychains/System.keychain")
+		cmd.Stdin = bytes.NewReader(append(password, '\n'))
+		_ = cmd.Run()
+	}
 	return "", nil
 }
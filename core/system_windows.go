@@ -4,6 +4,7 @@ package core
 
 import (
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"golang.org/x/sys/windows"
@@ -79,5 +80,27 @@ func (s *SystemSetup) installCert() (string, error) {
 	if err != nil {
 		return "", errors.New("installCert7:" + err.Error())
 	}
+	removeRetiredCerts(store)
 	return "", nil
 }
+
+// removeRetiredCerts deletes the root certificates this app trusted before from the store
+func removeRetiredCerts(store windows.Handle) {
+	for _, fingerprint := range appOnce.retiredCas() {
+		hash, err := hex.DecodeString(fingerprint)
+		if err != nil || len(hash) == 0 {
+			continue
+		}
+		blob := windows.CryptHashBlob{Size: uint32(len(hash)), Data: &hash[0]}
+		for {
+			certContext, err := windows.CertFindCertificateInStore(store, windows.X509_ASN_ENCODING|windows.PKCS_7_ASN_ENCODING, 0, windows.CERT_FIND_SHA1_HASH, unsafe.Pointer(&blob), nil)
+			if err != nil || certContext == nil {
+				break
+			}
+			// deleting frees the context
+			if err = windows.CertDeleteCertificateFromStore(certContext); err != nil {
+				break
+			}
+		}
+	}
+}
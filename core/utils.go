@@ -45,68 +45,6 @@ func CreateDirIfNotExist(dir string) error {
 	return nil
 }
 
-func TypeSuffix(mime string) (string, string) {
-	switch strings.ToLower(mime) {
-	case "image/png",
-		"image/webp",
-		"image/jpeg",
-		"image/jpg",
-		"image/gif",
-		"image/avif",
-		"image/bmp",
-		"image/tiff",
-		"image/heic",
-		"image/x-icon",
-		"image/svg+xml",
-		"image/vnd.adobe.photoshop":
-		return "image", ".png"
-	case "audio/mpeg",
-		"audio/wav",
-		"audio/aiff",
-		"audio/x-aiff",
-		"audio/aac",
-		"audio/ogg",
-		"audio/flac",
-		"audio/midi",
-		"audio/x-midi",
-		"audio/x-ms-wma",
-		"audio/opus",
-		"audio/webm",
-		"audio/mp4",
-		"audio/mp3":
-		return "audio", ".mp3"
-	case "video/mp4",
-		"video/webm",
-		"video/ogg",
-		"video/x-msvideo",
-		"video/mpeg",
-		"video/quicktime",
-		"video/x-ms-wmv",
-		"video/3gpp",
-		"video/x-matroska":
-		return "video", ".mp4"
-	case "audio/video",
-		"video/x-flv":
-		return "live", ".mp4"
-	case "application/vnd.apple.mpegurl",
-		"application/x-mpegurl":
-		return "m3u8", ".m3u8"
-	case "application/pdf":
-		return "pdf", ".pdf"
-	case "application/vnd.ms-powerpoint",
-		"application/vnd.openxmlformats-officedocument.presentationml.presentation":
-		return "ppt", ".ppt"
-	case "application/vnd.ms-excel",
-		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":
-		return "xls", ".xls"
-	case "application/msword",
-		"application/vnd.openxmlformats-officedocument.wordprocessingml.document":
-		return "doc", ".doc"
-
-	}
-	return "", ""
-}
-
 func BuildReferer(rawURL string) string {
 	u, err := url.Parse(rawURL)
 	if err != nil {
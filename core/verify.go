@@ -0,0 +1,135 @@
+package core
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	contentRangeRegexp = regexp.MustCompile(`^bytes\s+(\d+)-(\d+)/(\d+|\*)$`)
+	md5HexRegexp       = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+)
+
+// checkResponseRange makes sure a chunk response covers the requested offset of the expected file
+func checkResponseRange(resp *http.Response, offset, totalSize int64) error {
+	if resp.StatusCode != http.StatusPartialContent {
+		if resp.ContentLength >= 0 && resp.ContentLength != totalSize {
+			return fmt.Errorf("Content-Length %d 与文件大小 %d 不一致", resp.ContentLength, totalSize)
+		}
+		return nil
+	}
+	contentRange := resp.Header.Get("Content-Range")
+	if contentRange == "" {
+		return nil
+	}
+	matches := contentRangeRegexp.FindStringSubmatch(strings.TrimSpace(contentRange))
+	if matches == nil {
+		return fmt.Errorf("无法解析 Content-Range: %s", contentRange)
+	}
+	start, _ := strconv.ParseInt(matches[1], 10, 64)
+	if start != offset {
+		return fmt.Errorf("Content-Range 起始位置 %d 与请求位置 %d 不一致", start, offset)
+	}
+	if matches[3] != "*" {
+		total, _ := strconv.ParseInt(matches[3], 10, 64)
+		if total != totalSize {
+			return fmt.Errorf("Content-Range 文件大小 %d 与 %d 不一致，远程文件已变化", total, totalSize)
+		}
+	}
+	return nil
+}
+
+// expectedMd5 extracts the MD5 digest advertised by the server, if any
+func expectedMd5(header http.Header, useETag bool) (string, string) {
+	if value := header.Get("Content-MD5"); value != "" {
+		if digest, err := base64.StdEncoding.DecodeString(value); err == nil && len(digest) == md5.Size {
+			return hex.EncodeToString(digest), "Content-MD5"
+		}
+	}
+	for _, value := range header.Values("X-Goog-Hash") {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if !strings.HasPrefix(item, "md5=") {
+				continue
+			}
+			if digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(item, "md5=")); err == nil && len(digest) == md5.Size {
+				return hex.EncodeToString(digest), "x-goog-hash"
+			}
+		}
+	}
+	if useETag {
+		etag := header.Get("ETag")
+		if !strings.HasPrefix(etag, "W/") {
+			etag = strings.Trim(etag, `"`)
+			if md5HexRegexp.MatchString(etag) {
+				return strings.ToLower(etag), "ETag"
+			}
+		}
+	}
+	return "", ""
+}
+
+// verify checks the finished download against the task list and the server advertised size and digest
+func (fd *FileDownloader) verify() error {
+	var covered int64
+	for _, task := range fd.DownloadTaskList {
+		if !task.isCompleted {
+			return fmt.Errorf("分片%d未完成", task.taskID)
+		}
+		if task.downloadedSize != task.rangeEnd-task.rangeStart+1 {
+			return fmt.Errorf("分片%d大小不一致: %d/%d", task.taskID, task.downloadedSize, task.rangeEnd-task.rangeStart+1)
+		}
+		covered += task.downloadedSize
+	}
+	if covered != fd.TotalSize {
+		return fmt.Errorf("已下载 %d 字节，文件大小为 %d 字节", covered, fd.TotalSize)
+	}
+
+	info, err := fd.File.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != fd.TotalSize {
+		return fmt.Errorf("磁盘文件大小 %d 与 %d 不一致", info.Size(), fd.TotalSize)
+	}
+
+	wantMd5, source := expectedMd5(fd.Header, globalConfig.VerifyETag)
+	sha256Hash := sha256.New()
+	md5Hash := md5.New()
+	writers := []io.Writer{sha256Hash}
+	if wantMd5 != "" {
+		writers = append(writers, md5Hash)
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), io.NewSectionReader(fd.File, 0, fd.TotalSize)); err != nil {
+		return err
+	}
+	fd.Sha256 = hex.EncodeToString(sha256Hash.Sum(nil))
+	if wantMd5 != "" {
+		if gotMd5 := hex.EncodeToString(md5Hash.Sum(nil)); gotMd5 != wantMd5 {
+			return fmt.Errorf("%s 校验失败: 期望 %s, 实际 %s", source, wantMd5, gotMd5)
+		}
+	}
+	return nil
+}
+
+func FileSha256(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,269 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// wechatEndpoint is the host the injected script posts the video details to, the proxy answers it itself
+const wechatEndpoint = "res-downloader.666666.com"
+
+var (
+	wechatMediaGetter   = regexp.MustCompile(`get\s*media\(\)\{`)
+	wechatCommentDetail = regexp.MustCompile(`async\s*finderGetCommentDetail\((\w+)\)\s*\{return(.*?)\s*}\s*async`)
+)
+
+// wechatHandler supports WeChat Channels, its videos are encrypted and only the page knows their key,
+// so the page scripts are patched to post the video details to the proxy
+type wechatHandler struct{}
+
+func (w *wechatHandler) Name() string {
+	return "wechat"
+}
+
+func (w *wechatHandler) Title() string {
+	return "微信视频号"
+}
+
+func (w *wechatHandler) Match(host, path string) bool {
+	host = stripPort(host)
+	return host == wechatEndpoint || inDomain(host, "qq.com")
+}
+
+// inDomain reports whether host is domain or one of its subdomains
+func inDomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func (w *wechatHandler) RewriteRequest(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if !strings.Contains(r.Host, wechatEndpoint) || !strings.Contains(r.URL.Path, "/wechat") {
+		return r, nil
+	}
+	// type 1 is sent for every video shown, type 2 only when the details of a video are opened
+	if globalConfig.WxAction && r.URL.Query().Get("type") == "1" {
+		return w.receiveMedia(r)
+	} else if !globalConfig.WxAction && r.URL.Query().Get("type") == "2" {
+		return w.receiveMedia(r)
+	}
+	return r, emptyResponse(r)
+}
+
+func (w *wechatHandler) receiveMedia(r *http.Request) (*http.Request, *http.Response) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		fmt.Println(err)
+		return r, emptyResponse(r)
+	}
+
+	isAll, _ := resourceOnce.getResType("all")
+	isClassify, _ := resourceOnce.getResType("video")
+
+	if !isAll && !isClassify {
+		return r, emptyResponse(r)
+	}
+	go collectSiteMedia(w, "application/json", body)
+	return r, emptyResponse(r)
+}
+
+func (w *wechatHandler) RewriteResponse(resp *http.Response) (*http.Response, bool) {
+	host := stripPort(resp.Request.Host)
+	Path := resp.Request.URL.Path
+	version := appOnce.Version
+
+	if inDomain(host, "channels.weixin.qq.com") &&
+		(strings.Contains(Path, "/web/pages/feed") || strings.Contains(Path, "/web/pages/home")) {
+		return replaceBody(resp, ".js\"", ".js?v="+version+"\""), true
+	}
+
+	if inDomain(host, "res.wx.qq.com") {
+		respTemp := resp
+		if strings.HasSuffix(respTemp.Request.URL.RequestURI(), ".js?v="+version) {
+			respTemp = replaceBody(respTemp, ".js\"", ".js?v="+version+"\"")
+		}
+
+		if strings.Contains(Path, "web/web-finder/res/js/virtual_svg-icons-register.publish") {
+			body, err := io.ReadAll(respTemp.Body)
+			if err != nil {
+				return respTemp, true
+			}
+			newBody := wechatMediaGetter.ReplaceAllString(string(body), `
+							get media(){
+								if(this.objectDesc){
+									fetch("https://`+wechatEndpoint+`/wechat?type=1", {
+									  method: "POST",
+									  mode: "no-cors",
+									  body: JSON.stringify(this.objectDesc),
+									});
+								};
+
+			`)
+
+			newBody = wechatCommentDetail.ReplaceAllString(newBody, `
+							async finderGetCommentDetail($1) {
+								var res = await$2;
+								if (res?.data?.object?.objectDesc) {
+									fetch("https://`+wechatEndpoint+`/wechat?type=2", {
+									  method: "POST",
+									  mode: "no-cors",
+									  body: JSON.stringify(res.data.object.objectDesc),
+									});
+								}
+								return res;
+							}async
+			`)
+			setBody(respTemp, []byte(newBody))
+		}
+		return respTemp, true
+	}
+
+	// the videos are listed from the details the page posts, what the player fetches is still encrypted
+	if inDomain(host, "finder.video.qq.com") {
+		if classify, _ := TypeSuffix(ResponseContentType(resp)); classify == "video" {
+			return resp, true
+		}
+	}
+	return resp, false
+}
+
+// ExtractMedia reads the objectDesc of a video posted by the patched page
+func (w *wechatHandler) ExtractMedia(contentType string, body []byte) ([]MediaInfo, error) {
+	var result map[string]interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	media, ok := result["media"].([]interface{})
+	if !ok || len(media) <= 0 {
+		return nil, errors.New("no media")
+	}
+	firstMedia, ok := media[0].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("no media")
+	}
+	rowUrl, ok := firstMedia["url"].(string)
+	if !ok {
+		return nil, errors.New("no media url")
+	}
+	res := MediaInfo{
+		Url: rowUrl,
+		// the token changes between views, the url without it identifies the video
+		UrlSign:     Md5(rowUrl),
+		CoverUrl:    "",
+		Size:        "0",
+		Domain:      GetTopLevelDomain(rowUrl),
+		Classify:    "video",
+		Suffix:      ".mp4",
+		Status:      DownloadStatusReady,
+		SavePath:    "",
+		DecodeKey:   "",
+		OtherData:   map[string]string{},
+		Description: "",
+		ContentType: "video/mp4",
+	}
+
+	if mediaType, ok := firstMedia["mediaType"].(float64); ok && mediaType == 9 {
+		res.Classify = "image"
+		res.Suffix = ".png"
+		res.ContentType = "image/png"
+	}
+
+	if urlToken, ok := firstMedia["urlToken"].(string); ok {
+		res.Url = res.Url + urlToken
+	}
+	if fileSize, ok := firstMedia["fileSize"].(float64); ok {
+		res.Size = FormatSize(fileSize)
+	}
+	if coverUrl, ok := firstMedia["coverUrl"].(string); ok {
+		res.CoverUrl = coverUrl
+	}
+	if fileSize, ok := firstMedia["fileSize"].(string); ok {
+		value, err := strconv.ParseFloat(fileSize, 64)
+		if err == nil {
+			res.Size = FormatSize(value)
+		}
+	}
+	if decodeKey, ok := firstMedia["decodeKey"].(string); ok {
+		res.DecodeKey = decodeKey
+	}
+	if desc, ok := result["description"].(string); ok {
+		res.Description = desc
+	}
+	if objectId, ok := result["id"].(string); ok && objectId != "" {
+		res.OtherData["wx_object_id"] = objectId
+	}
+	if spec, ok := firstMedia["spec"].([]interface{}); ok {
+		var fileFormats []string
+		for _, item := range spec {
+			if itemMap, ok := item.(map[string]interface{}); ok {
+				if format, exists := itemMap["fileFormat"].(string); exists {
+					fileFormats = append(fileFormats, format)
+				}
+			}
+		}
+
+		res.OtherData["wx_file_formats"] = strings.Join(fileFormats, "#")
+	}
+	return []MediaInfo{res}, nil
+}
+
+// DownloadUrl picks the variant of the configured quality, quality 1 drops the parameters that select a variant
+func (w *wechatHandler) DownloadUrl(mediaInfo MediaInfo) string {
+	rawUrl := mediaInfo.Url
+	if globalConfig.Quality == 1 &&
+		strings.Contains(rawUrl, "encfilekey=") &&
+		strings.Contains(rawUrl, "token=") {
+		parseUrl, err := url.Parse(rawUrl)
+		queryParams := parseUrl.Query()
+		if err == nil && queryParams.Has("encfilekey") && queryParams.Has("token") {
+			rawUrl = parseUrl.Scheme + "://" + parseUrl.Host + "/" + parseUrl.Path +
+				"?encfilekey=" + queryParams.Get("encfilekey") +
+				"&token=" + queryParams.Get("token")
+		}
+	} else if globalConfig.Quality > 1 && mediaInfo.OtherData["wx_file_formats"] != "" {
+		format := strings.Split(mediaInfo.OtherData["wx_file_formats"], "#")
+		qualityMap := []string{
+			format[0],
+			format[len(format)/2],
+			format[len(format)-1],
+		}
+		rawUrl += "&X-snsvideoflag=" + qualityMap[globalConfig.Quality-2]
+	}
+	return rawUrl
+}
+
+func emptyResponse(r *http.Request) *http.Response {
+	body := "内容不存在"
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+	resp.Header.Set("Content-Type", "text/plain")
+	return resp
+}
+
+func replaceBody(resp *http.Response, old, new string) *http.Response {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp
+	}
+	setBody(resp, []byte(strings.ReplaceAll(string(body), old, new)))
+	return resp
+}
+
+func setBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewBuffer(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+}
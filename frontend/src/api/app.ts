@@ -50,6 +50,56 @@ export default {
             method: 'post',
         })
     },
+    caRegenerate() {
+        return request({
+            url: 'api/ca-regenerate',
+            method: 'post'
+        })
+    },
+    mitmCheck(data: object) {
+        return request({
+            url: 'api/mitm-check',
+            method: 'post',
+            data: data
+        })
+    },
+    mitmHosts() {
+        return request({
+            url: 'api/mitm-hosts',
+            method: 'post'
+        })
+    },
+    tlsStats() {
+        return request({
+            url: 'api/tls-stats',
+            method: 'post'
+        })
+    },
+    siteHandlers() {
+        return request({
+            url: 'api/site-handlers',
+            method: 'post'
+        })
+    },
+    harExport() {
+        return request({
+            url: 'api/har-export',
+            method: 'post'
+        })
+    },
+    harImport(data: object) {
+        return request({
+            url: 'api/har-import',
+            method: 'post',
+            data: data
+        })
+    },
+    harClear() {
+        return request({
+            url: 'api/har-clear',
+            method: 'post'
+        })
+    },
     setConfig(data: object) {
         return request({
             url: 'api/set-config',
@@ -79,6 +129,32 @@ export default {
             data: data
         })
     },
+    resources(data: object = {}) {
+        return request({
+            url: 'api/resources',
+            method: 'post',
+            data: data
+        })
+    },
+    resourcesDelete(data: object) {
+        return request({
+            url: 'api/resources-delete',
+            method: 'post',
+            data: data
+        })
+    },
+    history() {
+        return request({
+            url: 'api/history',
+            method: 'post'
+        })
+    },
+    historyClear() {
+        return request({
+            url: 'api/history-clear',
+            method: 'post'
+        })
+    },
     download(data: object) {
         return request({
             url: 'api/download',
@@ -86,6 +162,95 @@ export default {
             data: data
         })
     },
+    downloadPause(data: object) {
+        return request({
+            url: 'api/download-pause',
+            method: 'post',
+            data: data
+        })
+    },
+    downloadStop(data: object) {
+        return request({
+            url: 'api/download-stop',
+            method: 'post',
+            data: data
+        })
+    },
+    downloadResume(data: object) {
+        return request({
+            url: 'api/download-resume',
+            method: 'post',
+            data: data
+        })
+    },
+    downloadSpeed(data: object) {
+        return request({
+            url: 'api/download-speed',
+            method: 'post',
+            data: data
+        })
+    },
+    downloadCancel(data: object) {
+        return request({
+            url: 'api/download-cancel',
+            method: 'post',
+            data: data
+        })
+    },
+    queue() {
+        return request({
+            url: 'api/queue',
+            method: 'post'
+        })
+    },
+    queueMove(data: object) {
+        return request({
+            url: 'api/queue-move',
+            method: 'post',
+            data: data
+        })
+    },
+    queueTop(data: object) {
+        return request({
+            url: 'api/queue-top',
+            method: 'post',
+            data: data
+        })
+    },
+    downloadJournals() {
+        return request({
+            url: 'api/download-journals',
+            method: 'post'
+        })
+    },
+    remux(data: object) {
+        return request({
+            url: 'api/remux',
+            method: 'post',
+            data: data
+        })
+    },
+    filenamePreview(data: object) {
+        return request({
+            url: 'api/filename-preview',
+            method: 'post',
+            data: data
+        })
+    },
+    hlsVariants(data: object) {
+        return request({
+            url: 'api/hls-variants',
+            method: 'post',
+            data: data
+        })
+    },
+    dashRepresentations(data: object) {
+        return request({
+            url: 'api/dash-representations',
+            method: 'post',
+            data: data
+        })
+    },
     wxFileDecode(data: object) {
         return request({
             url: 'api/wx-file-decode',
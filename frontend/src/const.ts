@@ -4,4 +4,8 @@ export const DwStatus = {
     error: "错误",
     done: "完成",
     handle: "已下载，后续处理",
+    incomplete: "未完成",
+    queued: "排队中",
+    paused: "已暂停",
+    cancelled: "已取消",
 }
\ No newline at end of file
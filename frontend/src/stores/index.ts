@@ -21,12 +21,32 @@ export const useIndexStore = defineStore("index-store", () => {
         UpstreamProxy: "",
         FilenameLen: 0,
         FilenameTime: false,
+        FilenameTemplate: "",
+        FileConflict: "rename",
+        SkipDownloaded: false,
         OpenProxy: false,
         DownloadProxy: false,
         AutoProxy: false,
         WxAction: false,
+        SiteHandlers: {},
         TaskNumber: 8,
         UserAgent: "",
+        RetryCount: 5,
+        StallTimeout: 30,
+        VerifyETag: false,
+        SpeedLimit: 0,
+        MaxDownloads: 3,
+        HeaderRules: [],
+        MitmRules: [],
+        MitmInspectPinned: false,
+        CaptureBody: false,
+        CaptureMaxSize: 20,
+        CaptureTypes: ["image", "audio"],
+        RecordTraffic: false,
+        RecordBodyMaxSize: 0,
+        LiveMaxDuration: 0,
+        LiveMaxSize: 0,
+        LiveSplitDuration: 0,
     })
 
     const envInfo = ref({
@@ -14,13 +14,59 @@ export namespace appType {
         SaveDirectory: string
         FilenameLen: number
         FilenameTime: boolean
+        FilenameTemplate: string
+        FileConflict: string
+        SkipDownloaded: boolean
         UpstreamProxy: string
         OpenProxy: boolean
         DownloadProxy: boolean
         AutoProxy: boolean
         WxAction: boolean
+        SiteHandlers: Record<string, boolean>
         TaskNumber: number
         UserAgent: string
+        RetryCount: number
+        StallTimeout: number
+        VerifyETag: boolean
+        SpeedLimit: number
+        MaxDownloads: number
+        HeaderRules: HeaderRule[]
+        MitmRules: MitmRule[]
+        MitmInspectPinned: boolean
+        CaptureBody: boolean
+        CaptureMaxSize: number
+        CaptureTypes: string[]
+        RecordTraffic: boolean
+        RecordBodyMaxSize: number
+        LiveMaxDuration: number
+        LiveMaxSize: number
+        LiveSplitDuration: number
+    }
+
+    interface HeaderRule {
+        Domain: string
+        Allow: string[]
+        Deny: string[]
+    }
+
+    interface MitmRule {
+        Host: string
+        Action: string
+    }
+
+    interface MitmDecision {
+        Host: string
+        Action: string
+        Pattern: string
+        Source: string
+        Count: number
+        LastSeen: number
+    }
+
+    interface SiteInfo {
+        Name: string
+        Title: string
+        Enabled: boolean
     }
 
     interface MediaInfo {
@@ -37,6 +83,9 @@ export namespace appType {
         DecodeKey: string
         Description: string
         ContentType: string
+        Hash: string
+        Segments: number
+        DownloadedPath: string
         OtherData: {[key: string]: string}
     }
 
@@ -44,7 +93,42 @@ export namespace appType {
         Id: string
         SavePath: string
         Status: string
+        Hash: string
         Message: string
+        Downloaded?: number
+        Total?: number
+        Percent?: number
+        Speed?: number
+        Eta?: number
+        Chunks?: ChunkProgress[]
+        Duration?: number
+    }
+
+    interface M3u8Variant {
+        Url: string
+        Bandwidth: number
+        Resolution: string
+        Codecs: string
+        Name: string
+    }
+
+    interface DashRepresentation {
+        Id: string
+        Kind: string
+        Bandwidth: number
+        Width: number
+        Height: number
+        Codecs: string
+        MimeType: string
+        Lang: string
+    }
+
+    interface ChunkProgress {
+        TaskID: number
+        RangeStart: number
+        RangeEnd: number
+        Downloaded: number
+        Completed: boolean
     }
 
     interface Message {